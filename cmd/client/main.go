@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"test/internal/dht"
 	"test/internal/torrent"
 )
 
@@ -15,20 +23,186 @@ func getClientID() ([20]byte, error) {
 	return buf, nil
 }
 
-func main() {
-	tf, err := torrent.NewFile("file2.torrent")
+// verify checks the data under dir against the torrent and reports the
+// result. It exits non-zero if any piece is bad or missing, or a file is
+// missing.
+func verify(ctx context.Context, src, dir string) {
+	f, err := torrent.Open(src)
 	if err != nil {
 		log.Fatal(err)
 	}
+	f.Storage = torrent.FileStorage{Dir: dir}
+
+	r, err := f.Verify(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, fr := range r.Files {
+		pct := 100.0
+		if fr.Length > 0 {
+			pct = float64(fr.Good) / float64(fr.Length) * 100
+		}
+		if fr.Missing {
+			fmt.Printf("missing  %s\n", filepath.Join(fr.Path...))
+			continue
+		}
+		fmt.Printf("%6.2f%%  %s\n", pct, filepath.Join(fr.Path...))
+	}
+	fmt.Printf("pieces: %d good, %d bad, %d missing\n", r.Good, r.Bad, r.Missing)
+	for _, state := range []torrent.PieceState{torrent.PieceBad, torrent.PieceMissing} {
+		var indexes []string
+		for i, ps := range r.Pieces {
+			if ps == state {
+				indexes = append(indexes, fmt.Sprint(i))
+			}
+		}
+		if len(indexes) > 0 {
+			fmt.Printf("%s pieces: %s\n", state, strings.Join(indexes, ", "))
+		}
+	}
+
+	if !r.OK() {
+		os.Exit(1)
+	}
+}
+
+// listFlag is a flag that may be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// create builds a .torrent of the file or directory given in args.
+func create(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	out := fs.String("o", "", "output file, <name>.torrent by default")
+	pieceLength := fs.Int("l", 0, "piece length in bytes, chosen from the size by default")
+	comment := fs.String("c", "", "comment")
+	private := fs.Bool("p", false, "only use the trackers to find peers")
+	source := fs.String("s", "", "source tag, changes the info-hash")
+	var trackers, webSeeds listFlag
+	fs.Var(&trackers, "a", "tracker tier of comma separated announce URLs, may be repeated")
+	fs.Var(&webSeeds, "w", "web seed URL, may be repeated")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("usage: create [flags] <path>")
+	}
+	path := fs.Arg(0)
+
+	b := &torrent.Builder{
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   "client",
+		Private:     *private,
+		Source:      *source,
+		URLList:     webSeeds,
+	}
+	for _, tier := range trackers {
+		b.AnnounceList = append(b.AnnounceList, strings.Split(tier, ","))
+	}
+
+	buf, err := b.Build(ctx, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		*out = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+	if err := os.WriteFile(*out, buf, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	cmd := "download"
+	if len(args) > 0 && (args[0] == "seed" || args[0] == "verify" || args[0] == "create") {
+		cmd = args[0]
+		args = args[1:]
+	}
+
+	src := "file2.torrent"
+	if len(args) > 0 {
+		src = args[0]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if cmd == "create" {
+		create(ctx, args)
+		return
+	}
+
+	if cmd == "verify" {
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		verify(ctx, src, dir)
+		return
+	}
 
 	var port uint16 = 6881
 
+	node, err := dht.Listen(dht.Config{
+		Addr:           fmt.Sprintf(":%d", port),
+		BootstrapNodes: dht.DefaultBootstrapNodes,
+	})
+	if err != nil {
+		log.Printf("dht disabled: %v", err)
+	} else {
+		defer node.Close()
+	}
+
 	clientID, err := getClientID()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := tf.Download(clientID, port); err != nil {
+	if cmd == "seed" {
+		f, err := torrent.Open(src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.DHT = node
+		f.ResumeDir = "."
+
+		if err := f.Seed(ctx, clientID, port); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var tf torrent.Downloader
+	if strings.HasPrefix(src, "magnet:") {
+		m, err := torrent.ParseMagnet(src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m.DHT = node
+		m.ResumeDir = "."
+		tf = m
+	} else {
+		f, err := torrent.Open(src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.DHT = node
+		f.ResumeDir = "."
+		tf = f
+	}
+
+	if err := tf.DownloadContext(ctx, clientID, port); err != nil {
 		log.Fatal(err)
 	}
 }
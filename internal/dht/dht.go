@@ -0,0 +1,336 @@
+// Package dht implements a node of the Mainline DHT (BEP 5), the Kademlia
+// based distributed hash table BitTorrent clients use to find peers without
+// a tracker.
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"test/pkg/bencode"
+	"time"
+)
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+	// maintenanceInterval is how often questionable nodes are pinged and
+	// stale buckets refreshed.
+	maintenanceInterval = time.Minute
+	maxPacketSize       = 2048
+)
+
+// DefaultBootstrapNodes are well-known routers of the Mainline DHT.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	ErrTimeout = errors.New("dht query timed out")
+	ErrClosed  = errors.New("dht server closed")
+	ErrNoNodes = errors.New("no dht nodes responded")
+)
+
+type Config struct {
+	// ID is the node ID. A random ID is used if it is zero.
+	ID ID
+	// Addr is the UDP address to listen on, e.g. ":6881".
+	Addr string
+	// BootstrapNodes are the "host:port" addresses of the nodes used to join
+	// the network.
+	BootstrapNodes []string
+	// QueryTimeout is how long to wait for the response to a query.
+	QueryTimeout time.Duration
+}
+
+// Server is a DHT node. It answers queries from other nodes and runs lookups
+// for peers on behalf of the client.
+type Server struct {
+	id     ID
+	cfg    Config
+	conn   *net.UDPConn
+	table  *table
+	tokens *tokens
+	peers  *peerStore
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	nextTID uint16
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// transaction is a query waiting for its response.
+type transaction struct {
+	addr netip.AddrPort
+	resp chan *msg
+}
+
+// Listen starts a DHT node on cfg.Addr. It doesn't join the network until
+// Bootstrap is called.
+func Listen(cfg Config) (*Server, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ID == (ID{}) {
+		cfg.ID = RandomID()
+	}
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = defaultQueryTimeout
+	}
+
+	s := &Server{
+		id:      cfg.ID,
+		cfg:     cfg,
+		conn:    conn,
+		table:   newTable(cfg.ID),
+		tokens:  newTokens(),
+		peers:   newPeerStore(),
+		pending: make(map[string]*transaction),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.wg.Add(2)
+	go s.serve()
+	go s.maintain()
+
+	return s, nil
+}
+
+func (s *Server) ID() ID {
+	return s.id
+}
+
+// Addr returns the address the node listens on.
+func (s *Server) Addr() netip.AddrPort {
+	return s.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// NumNodes returns the number of nodes in the routing table.
+func (s *Server) NumNodes() int {
+	return s.table.len()
+}
+
+func (s *Server) Close() error {
+	s.cancel()
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		s.handle(buf[:n], from)
+	}
+}
+
+func (s *Server) handle(data []byte, from netip.AddrPort) {
+	var m msg
+	if err := bencode.Unmarshal(data, &m); err != nil {
+		return
+	}
+
+	switch m.Y {
+	case msgQuery:
+		s.handleQuery(&m, from)
+	case msgResponse, msgError:
+		s.mu.Lock()
+		tx, ok := s.pending[m.T]
+		s.mu.Unlock()
+
+		// responses must come from the node we queried
+		if !ok || tx.addr != from {
+			return
+		}
+		if m.Y == msgResponse && m.R != nil {
+			s.table.add(NodeInfo{ID: m.R.ID, Addr: from})
+		}
+		select {
+		case tx.resp <- &m:
+		default:
+		}
+	}
+}
+
+func (s *Server) handleQuery(m *msg, from netip.AddrPort) {
+	if m.A == nil {
+		s.sendError(from, m.T, ErrCodeProtocol, "missing arguments")
+		return
+	}
+
+	r := &msgReturn{ID: s.id}
+	switch m.Q {
+	case methodPing:
+	case methodFindNode:
+		r.Nodes, r.Nodes6 = encodeNodes(s.table.closest(m.A.Target, K))
+	case methodGetPeers:
+		r.Token = s.tokens.issue(from.Addr())
+		if peers := s.peers.get(m.A.InfoHash); len(peers) > 0 {
+			for _, p := range peers {
+				r.Values = append(r.Values, string(compactAddr(p)))
+			}
+		} else {
+			r.Nodes, r.Nodes6 = encodeNodes(s.table.closest(m.A.InfoHash, K))
+		}
+	case methodAnnouncePeer:
+		if !s.tokens.valid(m.A.Token, from.Addr()) {
+			s.sendError(from, m.T, ErrCodeProtocol, "bad token")
+			return
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = int(from.Port())
+		}
+		if port <= 0 || port > 0xffff {
+			s.sendError(from, m.T, ErrCodeProtocol, "invalid port")
+			return
+		}
+		s.peers.add(m.A.InfoHash, netip.AddrPortFrom(from.Addr(), uint16(port)))
+	default:
+		s.sendError(from, m.T, ErrCodeMethod, "method unknown")
+		return
+	}
+
+	s.table.add(NodeInfo{ID: m.A.ID, Addr: from})
+	s.send(from, &msg{T: m.T, Y: msgResponse, R: r})
+}
+
+func (s *Server) send(addr netip.AddrPort, m *msg) error {
+	b, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDPAddrPort(b, addr)
+	return err
+}
+
+func (s *Server) sendError(addr netip.AddrPort, t string, code int, message string) {
+	s.send(addr, &msg{T: t, Y: msgError, E: &Error{Code: code, Message: message}})
+}
+
+// query sends a query to the node at addr and waits for its response. KRPC
+// errors are returned as *Error.
+func (s *Server) query(ctx context.Context, addr netip.AddrPort, method string, args *msgArgs) (*msgReturn, error) {
+	args.ID = s.id
+	tx := &transaction{addr: addr, resp: make(chan *msg, 1)}
+
+	s.mu.Lock()
+	s.nextTID++
+	t := string(binary.BigEndian.AppendUint16(nil, s.nextTID))
+	s.pending[t] = tx
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(addr, &msg{T: t, Y: msgQuery, Q: method, A: args}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.cfg.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-tx.resp:
+		if m.Y == msgError {
+			if m.E == nil {
+				return nil, &Error{Code: ErrCodeGeneric}
+			}
+			return nil, m.E
+		}
+		if m.R == nil {
+			return nil, &Error{Code: ErrCodeProtocol, Message: "response without return values"}
+		}
+		return m.R, nil
+	case <-timer.C:
+		s.table.failed(addr)
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// Ping checks that the node at addr is alive and adds it to the routing
+// table.
+func (s *Server) Ping(ctx context.Context, addr netip.AddrPort) (ID, error) {
+	r, err := s.query(ctx, addr, methodPing, &msgArgs{})
+	if err != nil {
+		return ID{}, err
+	}
+	return r.ID, nil
+}
+
+// maintain pings questionable nodes, so bad ones get replaced, and refreshes
+// buckets nobody was heard from in a while.
+func (s *Server) maintain() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range s.table.questionable() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Ping(s.ctx, n.Addr)
+			}()
+		}
+		wg.Wait()
+
+		for _, id := range s.table.stale(goodDuration) {
+			s.lookup(s.ctx, id, methodFindNode, nil)
+		}
+	}
+}
+
+// resolve looks up "host:port" addresses, skipping the ones that fail.
+func resolve(addrs []string) []netip.AddrPort {
+	var result []netip.AddrPort
+	for _, a := range addrs {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			log.Printf("dht: %v", err)
+			continue
+		}
+		ap := addr.AddrPort()
+		result = append(result, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, bootstrap ...string) *Server {
+	t.Helper()
+
+	s, err := Listen(Config{Addr: "127.0.0.1:0", BootstrapNodes: bootstrap, QueryTimeout: 500 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newSwarm starts n nodes that all bootstrap from the first one.
+func newSwarm(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	router := newTestServer(t)
+	swarm := []*Server{router}
+	for range n - 1 {
+		s := newTestServer(t, router.Addr().String())
+		require.NoError(t, s.Bootstrap(ctx))
+		swarm = append(swarm, s)
+	}
+	return swarm
+}
+
+func TestServer_Ping(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+
+	id, err := a.Ping(context.Background(), b.Addr())
+	require.NoError(t, err)
+	require.Equal(t, b.ID(), id)
+
+	// both sides learned about each other
+	require.Equal(t, 1, a.NumNodes())
+	require.Equal(t, 1, b.NumNodes())
+}
+
+func TestServer_QueryErrors(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	ctx := context.Background()
+
+	_, err := a.query(ctx, b.Addr(), "vote", &msgArgs{})
+	var krpcErr *Error
+	require.ErrorAs(t, err, &krpcErr)
+	require.Equal(t, ErrCodeMethod, krpcErr.Code)
+
+	_, err = a.query(ctx, b.Addr(), methodAnnouncePeer, &msgArgs{InfoHash: ID{1}, Port: 80, Token: "forged"})
+	require.ErrorAs(t, err, &krpcErr)
+	require.Equal(t, ErrCodeProtocol, krpcErr.Code)
+}
+
+func TestServer_Timeout(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	addr := b.Addr()
+	b.Close()
+
+	_, err := a.Ping(context.Background(), addr)
+	require.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestServer_BootstrapFails(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	addr := b.Addr().String()
+	b.Close()
+
+	require.ErrorIs(t, a.Bootstrap(context.Background(), addr), ErrNoNodes)
+}
+
+func TestSwarm_AnnounceAndGetPeers(t *testing.T) {
+	swarm := newSwarm(t, 30)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, s := range swarm[1:] {
+		require.Greater(t, s.NumNodes(), 1)
+	}
+
+	infoHash := RandomID()
+
+	_, err := swarm[7].Announce(ctx, infoHash, 6881)
+	require.NoError(t, err)
+	_, err = swarm[21].Announce(ctx, infoHash, 0)
+	require.NoError(t, err)
+
+	peers, err := swarm[29].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []netip.AddrPort{
+		netip.AddrPortFrom(swarm[7].Addr().Addr(), 6881),
+		swarm[21].Addr(),
+	}, peers)
+
+	peers, err = swarm[29].GetPeers(ctx, RandomID())
+	require.NoError(t, err)
+	require.Empty(t, peers)
+}
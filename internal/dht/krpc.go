@@ -0,0 +1,236 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/netip"
+	"test/pkg/bencode"
+)
+
+// ID is a 160-bit node ID or info-hash.
+type ID [20]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal(string(id[:]))
+}
+
+func (id *ID) UnmarshalBencode(b []byte) error {
+	var s string
+	if err := bencode.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if len(s) != len(id) {
+		return fmt.Errorf("invalid node id length: %d", len(s))
+	}
+	copy(id[:], s)
+	return nil
+}
+
+// closer reports whether a is closer to id than b.
+func (id ID) closer(a, b ID) bool {
+	for i := range id {
+		da, db := a[i]^id[i], b[i]^id[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits id shares with other.
+func (id ID) commonPrefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// KRPC message types.
+const (
+	msgQuery    = "q"
+	msgResponse = "r"
+	msgError    = "e"
+)
+
+// KRPC query methods.
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes.
+const (
+	ErrCodeGeneric  = 201
+	ErrCodeServer   = 202
+	ErrCodeProtocol = 203
+	ErrCodeMethod   = 204
+)
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func (e *Error) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal([]any{e.Code, e.Message})
+}
+
+func (e *Error) UnmarshalBencode(b []byte) error {
+	var list []any
+	if err := bencode.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	if len(list) != 2 {
+		return errors.New("invalid krpc error")
+	}
+	code, ok := list[0].(int)
+	if !ok {
+		return errors.New("invalid krpc error code")
+	}
+	msg, _ := list[1].(string)
+	e.Code, e.Message = code, msg
+	return nil
+}
+
+// msg is a single KRPC message. Exactly one of A, R and E is set, depending
+// on Y.
+type msg struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q,omitempty"`
+	A *msgArgs   `bencode:"a"`
+	R *msgReturn `bencode:"r"`
+	E *Error     `bencode:"e"`
+	V string     `bencode:"v,omitempty"`
+}
+
+// msgArgs are the arguments of a query.
+type msgArgs struct {
+	ID          ID     `bencode:"id"`
+	Target      ID     `bencode:"target,omitempty"`
+	InfoHash    ID     `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+// msgReturn are the return values of a response. Nodes are in compact node
+// info form, values in compact peer info form.
+type msgReturn struct {
+	ID     ID       `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+}
+
+// NodeInfo is the contact information of a DHT node.
+type NodeInfo struct {
+	ID   ID
+	Addr netip.AddrPort
+}
+
+const (
+	compactNodeLen  = 26
+	compactNode6Len = 38
+)
+
+func compactAddr(addr netip.AddrPort) []byte {
+	b := addr.Addr().Unmap().AsSlice()
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+func parseCompactAddr(b []byte) (netip.AddrPort, error) {
+	ip, ok := netip.AddrFromSlice(b[:len(b)-2])
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid compact address length: %d", len(b))
+	}
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[len(b)-2:])), nil
+}
+
+// encodeNodes encodes nodes in compact node info form, IPv4 nodes into the
+// first and IPv6 nodes into the second string.
+func encodeNodes(nodes []NodeInfo) (string, string) {
+	var nodes4, nodes6 []byte
+	for _, n := range nodes {
+		if n.Addr.Addr().Unmap().Is4() {
+			nodes4 = append(nodes4, n.ID[:]...)
+			nodes4 = append(nodes4, compactAddr(n.Addr)...)
+		} else {
+			nodes6 = append(nodes6, n.ID[:]...)
+			nodes6 = append(nodes6, compactAddr(n.Addr)...)
+		}
+	}
+	return string(nodes4), string(nodes6)
+}
+
+func decodeNodes(s string, size int) ([]NodeInfo, error) {
+	if len(s)%size != 0 {
+		return nil, fmt.Errorf("compact node info has invalid length: %d", len(s))
+	}
+	nodes := make([]NodeInfo, 0, len(s)/size)
+	for i := 0; i < len(s); i += size {
+		var n NodeInfo
+		copy(n.ID[:], s[i:i+20])
+		addr, err := parseCompactAddr([]byte(s[i+20 : i+size]))
+		if err != nil {
+			return nil, err
+		}
+		n.Addr = addr
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// nodes returns the IPv4 and IPv6 nodes of the response.
+func (r *msgReturn) nodes() ([]NodeInfo, error) {
+	nodes, err := decodeNodes(r.Nodes, compactNodeLen)
+	if err != nil {
+		return nil, err
+	}
+	nodes6, err := decodeNodes(r.Nodes6, compactNode6Len)
+	if err != nil {
+		return nil, err
+	}
+	return append(nodes, nodes6...), nil
+}
+
+// peers returns the peers of a get_peers response, skipping malformed values.
+func (r *msgReturn) peers() []netip.AddrPort {
+	peers := make([]netip.AddrPort, 0, len(r.Values))
+	for _, v := range r.Values {
+		if len(v) != net.IPv4len+2 && len(v) != net.IPv6len+2 {
+			continue
+		}
+		addr, err := parseCompactAddr([]byte(v))
+		if err != nil {
+			continue
+		}
+		peers = append(peers, addr)
+	}
+	return peers
+}
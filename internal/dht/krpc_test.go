@@ -0,0 +1,87 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsg_RoundTrip(t *testing.T) {
+	id := ID{1, 2, 3}
+	nodes, nodes6 := encodeNodes([]NodeInfo{
+		{ID: ID{4}, Addr: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{ID: ID{5}, Addr: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+	})
+
+	tests := map[string]struct {
+		in   *msg
+		want string
+	}{
+		"query": {
+			in:   &msg{T: "aa", Y: msgQuery, Q: methodPing, A: &msgArgs{ID: id}},
+			want: "d1:ad2:id20:" + string(id[:]) + "e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		"response": {
+			in: &msg{T: "aa", Y: msgResponse, R: &msgReturn{ID: id, Nodes: nodes, Nodes6: nodes6}},
+		},
+		"error": {
+			in:   &msg{T: "aa", Y: msgError, E: &Error{Code: ErrCodeMethod, Message: "method unknown"}},
+			want: "d1:eli204e14:method unknowne1:t2:aa1:y1:ee",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := bencode.Marshal(tt.in)
+			require.NoError(t, err)
+			if tt.want != "" {
+				require.Equal(t, tt.want, string(b))
+			}
+
+			var got msg
+			require.NoError(t, bencode.Unmarshal(b, &got))
+			require.Equal(t, tt.in, &got)
+		})
+	}
+}
+
+func TestMsgReturn_Nodes(t *testing.T) {
+	want := []NodeInfo{
+		{ID: ID{4}, Addr: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{ID: ID{5}, Addr: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+	}
+
+	r := &msgReturn{}
+	r.Nodes, r.Nodes6 = encodeNodes(want)
+	require.Len(t, r.Nodes, compactNodeLen)
+	require.Len(t, r.Nodes6, compactNode6Len)
+
+	got, err := r.nodes()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	r.Nodes = r.Nodes[1:]
+	_, err = r.nodes()
+	require.Error(t, err)
+}
+
+func TestMsgReturn_Peers(t *testing.T) {
+	r := &msgReturn{Values: []string{
+		string(compactAddr(netip.MustParseAddrPort("10.0.0.1:80"))),
+		"bad",
+		string(compactAddr(netip.MustParseAddrPort("[::1]:443"))),
+	}}
+
+	require.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:80"),
+		netip.MustParseAddrPort("[::1]:443"),
+	}, r.peers())
+}
+
+func TestID_UnmarshalInvalid(t *testing.T) {
+	var m msg
+	require.Error(t, bencode.Unmarshal([]byte("d1:ad2:id3:abce1:q4:ping1:t2:aa1:y1:qe"), &m))
+}
@@ -0,0 +1,192 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// alpha is the number of concurrent queries of a lookup.
+const alpha = 3
+
+// contact is a node that responded during a lookup, along with the token it
+// handed out for announce_peer.
+type contact struct {
+	NodeInfo
+	token string
+}
+
+type lookupReply struct {
+	addr netip.AddrPort
+	r    *msgReturn
+	err  error
+}
+
+// lookup iteratively queries the nodes closest to target with find_node or
+// get_peers until the K closest nodes known have all been queried. The seeds
+// are queried first regardless of their distance, their IDs being unknown.
+// It returns the K closest nodes that responded and any peers found.
+func (s *Server) lookup(ctx context.Context, target ID, method string, seeds []netip.AddrPort) ([]contact, []netip.AddrPort) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	replies := make(chan lookupReply)
+	inflight := 0
+	queried := make(map[netip.AddrPort]bool)
+
+	start := func(addr netip.AddrPort) {
+		queried[addr] = true
+		inflight++
+		go func() {
+			args := &msgArgs{Target: target}
+			if method == methodGetPeers {
+				args = &msgArgs{InfoHash: target}
+			}
+			r, err := s.query(ctx, addr, method, args)
+			select {
+			case replies <- lookupReply{addr: addr, r: r, err: err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	for _, addr := range seeds {
+		if !queried[addr] {
+			start(addr)
+		}
+	}
+
+	candidates := s.table.closest(target, K)
+	var responded []contact
+	peers := make(map[netip.AddrPort]bool)
+
+	for {
+		sortByDistance(candidates, target)
+		for _, c := range candidates[:min(K, len(candidates))] {
+			if inflight >= alpha {
+				break
+			}
+			if !queried[c.Addr] {
+				start(c.Addr)
+			}
+		}
+
+		if inflight == 0 {
+			break
+		}
+
+		var rep lookupReply
+		select {
+		case rep = <-replies:
+			inflight--
+		case <-ctx.Done():
+			return closestContacts(responded, target), peerList(peers)
+		}
+
+		if rep.err != nil {
+			candidates = slices.DeleteFunc(candidates, func(n NodeInfo) bool { return n.Addr == rep.addr })
+			continue
+		}
+
+		responded = append(responded, contact{NodeInfo: NodeInfo{ID: rep.r.ID, Addr: rep.addr}, token: rep.r.Token})
+		for _, p := range rep.r.peers() {
+			peers[p] = true
+		}
+
+		nodes, err := rep.r.nodes()
+		if err != nil {
+			continue
+		}
+		for _, n := range nodes {
+			if n.ID == s.id || queried[n.Addr] || slices.ContainsFunc(candidates, func(c NodeInfo) bool { return c.Addr == n.Addr }) {
+				continue
+			}
+			candidates = append(candidates, n)
+		}
+	}
+
+	return closestContacts(responded, target), peerList(peers)
+}
+
+func closestContacts(contacts []contact, target ID) []contact {
+	slices.SortFunc(contacts, func(a, b contact) int {
+		switch {
+		case target.closer(a.ID, b.ID):
+			return -1
+		case target.closer(b.ID, a.ID):
+			return 1
+		}
+		return 0
+	})
+	return contacts[:min(K, len(contacts))]
+}
+
+func peerList(peers map[netip.AddrPort]bool) []netip.AddrPort {
+	list := make([]netip.AddrPort, 0, len(peers))
+	for p := range peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// Bootstrap joins the network by looking up our own ID through the
+// configured bootstrap nodes and addrs, e.g. the nodes of a torrent file.
+func (s *Server) Bootstrap(ctx context.Context, addrs ...string) error {
+	seeds := resolve(append(slices.Clone(s.cfg.BootstrapNodes), addrs...))
+	s.lookup(ctx, s.id, methodFindNode, seeds)
+
+	if s.table.len() == 0 {
+		return ErrNoNodes
+	}
+	return nil
+}
+
+// GetPeers looks up the peers of infoHash.
+func (s *Server) GetPeers(ctx context.Context, infoHash ID) ([]netip.AddrPort, error) {
+	closest, peers := s.lookup(ctx, infoHash, methodGetPeers, nil)
+	if len(closest) == 0 {
+		return nil, ErrNoNodes
+	}
+	return peers, nil
+}
+
+// Announce looks up the peers of infoHash and announces to the closest nodes
+// that we accept connections for it on port. A zero port announces the
+// port the DHT node listens on.
+func (s *Server) Announce(ctx context.Context, infoHash ID, port uint16) ([]netip.AddrPort, error) {
+	closest, peers := s.lookup(ctx, infoHash, methodGetPeers, nil)
+
+	args := msgArgs{InfoHash: infoHash, Port: int(port)}
+	if port == 0 {
+		args.ImpliedPort = 1
+	}
+
+	var mu sync.Mutex
+	announced := 0
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			args := args
+			args.Token = c.token
+			if _, err := s.query(ctx, c.Addr, methodAnnouncePeer, &args); err != nil {
+				return
+			}
+			mu.Lock()
+			announced++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return peers, ErrNoNodes
+	}
+	return peers, nil
+}
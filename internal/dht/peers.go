@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// peerTTL is how long an announced peer is handed out.
+	peerTTL = 30 * time.Minute
+	// maxPeerValues is the number of peers returned by get_peers.
+	maxPeerValues = 50
+	// maxStoredPeers bounds the peers stored per info-hash.
+	maxStoredPeers = 1000
+	// maxInfoHashes bounds the info-hashes peers are stored for. When full,
+	// the one announced to least recently makes room for a new one.
+	maxInfoHashes = 10000
+)
+
+// peerStore holds the peers announced to us.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[ID]map[netip.AddrPort]time.Time
+	// announced is when a peer was last announced for every info-hash.
+	announced map[ID]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		peers:     make(map[ID]map[netip.AddrPort]time.Time),
+		announced: make(map[ID]time.Time),
+	}
+}
+
+func (s *peerStore) add(infoHash ID, peer netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxInfoHashes {
+			s.evictOldest()
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		s.peers[infoHash] = peers
+	}
+	if _, ok := peers[peer]; !ok && len(peers) >= maxStoredPeers {
+		return
+	}
+	peers[peer] = time.Now()
+	s.announced[infoHash] = peers[peer]
+}
+
+// evictOldest drops the info-hash announced to least recently. s.mu must be
+// held.
+func (s *peerStore) evictOldest() {
+	var (
+		oldest ID
+		at     time.Time
+	)
+	for infoHash, announced := range s.announced {
+		if at.IsZero() || announced.Before(at) {
+			oldest, at = infoHash, announced
+		}
+	}
+	delete(s.peers, oldest)
+	delete(s.announced, oldest)
+}
+
+// get returns up to maxPeerValues live peers of infoHash, dropping expired
+// ones.
+func (s *peerStore) get(infoHash ID) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []netip.AddrPort
+	for peer, added := range s.peers[infoHash] {
+		if time.Since(added) > peerTTL {
+			delete(s.peers[infoHash], peer)
+			continue
+		}
+		if len(result) < maxPeerValues {
+			result = append(result, peer)
+		}
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+		delete(s.announced, infoHash)
+	}
+	return result
+}
@@ -0,0 +1,29 @@
+package dht
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerStore_EvictsOldestInfoHash(t *testing.T) {
+	s := newPeerStore()
+	peer := netip.MustParseAddrPort("10.0.0.1:6881")
+
+	var infoHash ID
+	for i := range maxInfoHashes {
+		binary.BigEndian.PutUint32(infoHash[:], uint32(i))
+		s.add(infoHash, peer)
+	}
+	old := ID{0, 0, 0, 7}
+	s.announced[old] = time.Now().Add(-time.Hour)
+
+	s.add(ID{0xff}, peer)
+	require.Len(t, s.peers, maxInfoHashes)
+	require.Empty(t, s.get(old))
+	require.Equal(t, []netip.AddrPort{peer}, s.get(ID{0xff}))
+	require.Equal(t, []netip.AddrPort{peer}, s.get(ID{}))
+}
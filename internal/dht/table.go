@@ -0,0 +1,203 @@
+package dht
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the maximum number of nodes in a bucket, and the number of nodes
+	// returned by find_node and get_peers.
+	K = 8
+	// goodDuration is how long a node stays good after we last heard from it.
+	goodDuration = 15 * time.Minute
+	// maxFailures is the number of unanswered queries after which a node is
+	// bad and gets replaced.
+	maxFailures = 2
+)
+
+type node struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) good() bool {
+	return n.failures == 0 && time.Since(n.lastSeen) < goodDuration
+}
+
+func (n *node) bad() bool {
+	return n.failures >= maxFailures
+}
+
+// bucket holds the nodes sharing a prefix of a given length with our own ID,
+// least recently seen first.
+type bucket struct {
+	nodes   []*node
+	changed time.Time
+}
+
+// table is the routing table. Bucket i holds the nodes whose IDs share
+// exactly i leading bits with our own ID, so closer buckets cover smaller
+// parts of the ID space.
+type table struct {
+	self ID
+
+	mu      sync.Mutex
+	buckets [len(ID{}) * 8]bucket
+}
+
+func newTable(self ID) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].changed = now
+	}
+	return t
+}
+
+func (t *table) bucketIndex(id ID) int {
+	return min(t.self.commonPrefixLen(id), len(t.buckets)-1)
+}
+
+// add records that we heard from n. It returns false if the node's bucket
+// is full of nodes that aren't bad.
+func (t *table) add(n NodeInfo) bool {
+	if n.ID == t.self || !n.Addr.IsValid() {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[t.bucketIndex(n.ID)]
+	now := time.Now()
+
+	if i := slices.IndexFunc(b.nodes, func(e *node) bool { return e.ID == n.ID }); i >= 0 {
+		e := b.nodes[i]
+		e.Addr = n.Addr
+		e.lastSeen = now
+		e.failures = 0
+		b.nodes = append(slices.Delete(b.nodes, i, i+1), e)
+		b.changed = now
+		return true
+	}
+
+	if len(b.nodes) >= K {
+		i := slices.IndexFunc(b.nodes, (*node).bad)
+		if i < 0 {
+			return false
+		}
+		b.nodes = slices.Delete(b.nodes, i, i+1)
+	}
+
+	b.nodes = append(b.nodes, &node{NodeInfo: n, lastSeen: now})
+	b.changed = now
+	return true
+}
+
+// failed records an unanswered query to the node at addr.
+func (t *table) failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.Addr == addr {
+				n.failures++
+			}
+		}
+	}
+}
+
+// closest returns up to count good or questionable nodes closest to target.
+func (t *table) closest(target ID, count int) []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if !n.bad() {
+				nodes = append(nodes, n.NodeInfo)
+			}
+		}
+	}
+
+	sortByDistance(nodes, target)
+	return nodes[:min(count, len(nodes))]
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].nodes)
+	}
+	return n
+}
+
+// questionable returns the nodes we haven't heard from recently, which
+// should be pinged.
+func (t *table) questionable() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []NodeInfo
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if !n.good() && !n.bad() {
+				nodes = append(nodes, n.NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+// stale returns random IDs in the ranges of the non-empty buckets that
+// haven't changed for d. Looking them up refreshes the buckets.
+func (t *table) stale(d time.Duration) []ID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ids []ID
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.nodes) == 0 || time.Since(b.changed) < d {
+			continue
+		}
+		ids = append(ids, randomIDInBucket(t.self, i))
+	}
+	return ids
+}
+
+// randomIDInBucket returns a random ID sharing exactly prefix leading bits
+// with self.
+func randomIDInBucket(self ID, prefix int) ID {
+	id := RandomID()
+	for i := 0; i < prefix; i++ {
+		mask := byte(0x80 >> (i % 8))
+		id[i/8] = id[i/8]&^mask | self[i/8]&mask
+	}
+	if prefix < len(id)*8 {
+		mask := byte(0x80 >> (prefix % 8))
+		id[prefix/8] = id[prefix/8]&^mask | ^self[prefix/8]&mask
+	}
+	return id
+}
+
+func sortByDistance(nodes []NodeInfo, target ID) {
+	slices.SortFunc(nodes, func(a, b NodeInfo) int {
+		switch {
+		case target.closer(a.ID, b.ID):
+			return -1
+		case target.closer(b.ID, a.ID):
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testNode(id ID, port int) NodeInfo {
+	return NodeInfo{ID: id, Addr: netip.MustParseAddrPort(fmt.Sprintf("127.0.0.1:%d", port))}
+}
+
+func TestTable_BucketFull(t *testing.T) {
+	self := ID{}
+	tbl := newTable(self)
+
+	// all of these share no prefix with self and land in bucket 0
+	for i := range K {
+		require.True(t, tbl.add(testNode(ID{0x80, byte(i)}, 1000+i)))
+	}
+	require.False(t, tbl.add(testNode(ID{0x80, 0xff}, 2000)))
+
+	// a bad node makes room
+	tbl.failed(netip.MustParseAddrPort("127.0.0.1:1003"))
+	tbl.failed(netip.MustParseAddrPort("127.0.0.1:1003"))
+	require.True(t, tbl.add(testNode(ID{0x80, 0xff}, 2000)))
+	require.Equal(t, K, tbl.len())
+
+	// nodes in other buckets are unaffected
+	require.True(t, tbl.add(testNode(ID{0x01}, 3000)))
+	require.Equal(t, K+1, tbl.len())
+
+	// we never add ourselves
+	require.False(t, tbl.add(testNode(self, 4000)))
+}
+
+func TestTable_Closest(t *testing.T) {
+	tbl := newTable(ID{})
+	for i := 1; i <= 20; i++ {
+		tbl.add(testNode(ID{byte(i)}, 1000+i))
+	}
+
+	got := tbl.closest(ID{0x10}, 3)
+	require.Equal(t, []ID{{0x10}, {0x11}, {0x12}}, []ID{got[0].ID, got[1].ID, got[2].ID})
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	self := RandomID()
+	for _, prefix := range []int{0, 1, 7, 8, 13, 159} {
+		id := randomIDInBucket(self, prefix)
+		require.Equal(t, prefix, self.commonPrefixLen(id))
+	}
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// tokenRotation is how often the token secret changes. Tokens stay valid
+// for one more rotation, so peers have at least that long to announce.
+const tokenRotation = 5 * time.Minute
+
+// tokens hands out and checks the write tokens of get_peers and
+// announce_peer. A token is bound to the IP address it was given to.
+type tokens struct {
+	mu      sync.Mutex
+	secret  [20]byte
+	prev    [20]byte
+	rotated time.Time
+}
+
+func newTokens() *tokens {
+	t := &tokens{rotated: time.Now()}
+	rand.Read(t.secret[:])
+	t.prev = t.secret
+	return t
+}
+
+func (t *tokens) rotate() {
+	if time.Since(t.rotated) < tokenRotation {
+		return
+	}
+	t.prev = t.secret
+	rand.Read(t.secret[:])
+	t.rotated = time.Now()
+}
+
+func tokenFor(secret [20]byte, ip netip.Addr) string {
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip.Unmap().AsSlice())
+	return string(mac.Sum(nil)[:8])
+}
+
+func (t *tokens) issue(ip netip.Addr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	return tokenFor(t.secret, ip)
+}
+
+func (t *tokens) valid(token string, ip netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	return hmac.Equal([]byte(token), []byte(tokenFor(t.secret, ip))) ||
+		hmac.Equal([]byte(token), []byte(tokenFor(t.prev, ip)))
+}
@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAnnounceInterval is used when a tracker doesn't send an interval.
+	defaultAnnounceInterval = 30 * time.Minute
+	// minRetryDelay is the delay after the first failed announce, doubled on
+	// every consecutive failure up to the announce interval.
+	minRetryDelay = 15 * time.Second
+	// stoppedTimeout bounds the stopped announce sent on shutdown.
+	stoppedTimeout = 10 * time.Second
+)
+
+// TransferStats are the counters reported to trackers.
+type TransferStats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// Announcer keeps a torrent registered with its trackers. It sends the
+// started, completed and stopped events and re-announces at the interval
+// requested by the tracker.
+type Announcer struct {
+	tracker Tracker
+	req     AnnounceRequest
+	stats   func() TransferStats
+
+	completed chan struct{}
+	once      sync.Once
+
+	mu          sync.Mutex
+	interval    time.Duration
+	minInterval time.Duration
+	last        time.Time
+}
+
+// NewAnnouncer returns an Announcer that sends req, with the transfer counters
+// taken from stats, to tracker.
+func NewAnnouncer(tracker Tracker, req AnnounceRequest, stats func() TransferStats) *Announcer {
+	return &Announcer{
+		tracker:   tracker,
+		req:       req,
+		stats:     stats,
+		completed: make(chan struct{}),
+		interval:  defaultAnnounceInterval,
+	}
+}
+
+// Completed signals that the download has finished. The completed event is
+// sent by Run once.
+func (a *Announcer) Completed() {
+	a.once.Do(func() { close(a.completed) })
+}
+
+// Announce sends a single announce with the current transfer counters and
+// records the intervals of the response.
+func (a *Announcer) Announce(ctx context.Context, event Event) (*TrackerResponse, error) {
+	req := a.req
+	req.Event = event
+	if a.stats != nil {
+		stats := a.stats()
+		req.Uploaded = stats.Uploaded
+		req.Downloaded = stats.Downloaded
+		req.Left = stats.Left
+	}
+
+	resp, err := a.tracker.Announce(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.last = time.Now()
+	if resp.Interval > 0 {
+		a.interval = time.Duration(resp.Interval) * time.Second
+	}
+	if resp.MinInterval > 0 {
+		a.minInterval = time.Duration(resp.MinInterval) * time.Second
+	}
+
+	return resp, nil
+}
+
+// next returns the delay until the next regular announce.
+func (a *Announcer) next() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return max(a.interval, a.minInterval) - time.Since(a.last)
+}
+
+// retryDelay returns the delay after the given number of consecutive
+// failures, never shorter than the tracker's min interval.
+func (a *Announcer) retryDelay(failures int) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delay := minRetryDelay << min(failures-1, 10)
+	return max(min(delay, a.interval), a.minInterval)
+}
+
+// Run re-announces until ctx is cancelled, passing the peers of every
+// response to onPeers. It expects the started event to have been sent with
+// Announce and sends the stopped event before returning.
+func (a *Announcer) Run(ctx context.Context, onPeers func([]Peer)) {
+	completed := a.completed
+	event := EventNone
+	failures := 0
+	timer := time.NewTimer(a.next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			stopCtx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+			defer cancel()
+			select {
+			case <-completed:
+				// completion raced with shutdown, the tracker still has to
+				// hear about it
+				if _, err := a.Announce(stopCtx, EventCompleted); err != nil {
+					log.Printf("completed announce failed: %v", err)
+				}
+			default:
+			}
+			if _, err := a.Announce(stopCtx, EventStopped); err != nil {
+				log.Printf("stopped announce failed: %v", err)
+			}
+			return
+		case <-completed:
+			// a nil channel blocks forever, so completed is only seen once
+			completed = nil
+			event = EventCompleted
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		resp, err := a.Announce(ctx, event)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			// a failed event is retried with the next announce
+			failures++
+			log.Printf("announce failed: %v", err)
+			timer.Reset(a.retryDelay(failures))
+			continue
+		}
+
+		event = EventNone
+		failures = 0
+		if onPeers != nil {
+			onPeers(resp.AllPeers())
+		}
+		timer.Reset(a.next())
+	}
+}
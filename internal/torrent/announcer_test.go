@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingTracker struct {
+	mu       sync.Mutex
+	requests []AnnounceRequest
+	interval int
+}
+
+func (t *recordingTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests = append(t.requests, *req)
+	return &TrackerResponse{Interval: t.interval, Peers: PeerList{{IP: "10.0.0.1", Port: 1}}}, nil
+}
+
+func (t *recordingTracker) events() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := make([]Event, len(t.requests))
+	for i, req := range t.requests {
+		events[i] = req.Event
+	}
+	return events
+}
+
+func TestAnnouncer_Events(t *testing.T) {
+	tr := &recordingTracker{interval: 1}
+
+	var mu sync.Mutex
+	stats := TransferStats{Left: 100}
+	ann := NewAnnouncer(tr, AnnounceRequest{Port: 6881}, func() TransferStats {
+		mu.Lock()
+		defer mu.Unlock()
+		return stats
+	})
+
+	_, err := ann.Announce(context.Background(), EventStarted)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := make(chan []Peer, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ann.Run(ctx, func(p []Peer) { peers <- p })
+	}()
+
+	// the regular re-announce after the tracker's interval
+	select {
+	case p := <-peers:
+		require.Equal(t, []Peer{{IP: "10.0.0.1", Port: 1}}, p)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no re-announce")
+	}
+
+	mu.Lock()
+	stats = TransferStats{Downloaded: 100, Uploaded: 5}
+	mu.Unlock()
+
+	ann.Completed()
+	cancel()
+	<-done
+
+	require.Equal(t, []Event{EventStarted, EventNone, EventCompleted, EventStopped}, tr.events())
+
+	last := tr.requests[len(tr.requests)-1]
+	require.Equal(t, int64(100), last.Downloaded)
+	require.Equal(t, int64(5), last.Uploaded)
+	require.Equal(t, int64(0), last.Left)
+	require.Equal(t, uint16(6881), last.Port)
+}
+
+func TestHTTPTracker_EchoesTrackerID(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.Query().Get("trackerid"))
+		buf, _ := bencode.Marshal(map[string]any{"interval": 60, "tracker id": "abc", "peers": ""})
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	tr := &HTTPTracker{URL: srv.URL}
+	for range 2 {
+		_, err := tr.Announce(context.Background(), &AnnounceRequest{Event: EventStarted})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"", "abc"}, got)
+}
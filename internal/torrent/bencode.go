@@ -2,7 +2,12 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"test/pkg/bencode"
 )
 
@@ -14,42 +19,153 @@ const (
 )
 
 type bencodeTorrent struct {
-	Announce     string      `bencode:"announce"`
-	AnnounceList [][]string  `bencode:"announce-list"`
-	CreationDate int64       `bencode:"creation date"`
-	Comment      string      `bencode:"comment"`
-	CreatedBy    string      `bencode:"created by"`
-	Encoding     string      `bencode:"encoding"`
-	Info         bencodeInfo `bencode:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	Encoding     string     `bencode:"encoding,omitempty"`
+	// Nodes are DHT nodes to bootstrap from, given by trackerless torrents.
+	Nodes []dhtNode `bencode:"nodes,omitempty"`
+	// URLList are web seed URLs (BEP 19).
+	URLList urlList `bencode:"url-list,omitempty"`
+	// HTTPSeeds are HTTP seed URLs (BEP 17).
+	HTTPSeeds urlList `bencode:"httpseeds,omitempty"`
+	// PieceLayers maps the pieces root of every v2 file larger than a piece
+	// to the hashes of its pieces (BEP 52).
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+	// Info is kept raw so the info-hash is computed over the exact bytes
+	// that appeared in the .torrent, including keys bencodeInfo doesn't model.
+	Info bencode.RawMessage `bencode:"info"`
+}
+
+// dhtNode is an entry of the nodes list, a ["host", port] pair (BEP 5),
+// decoded into "host:port".
+type dhtNode string
+
+func (n *dhtNode) UnmarshalBencode(b []byte) error {
+	var pair []interface{}
+	if err := bencode.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("invalid node: %v", pair)
+	}
+	host, ok := pair[0].(string)
+	port, ok2 := pair[1].(int)
+	if !ok || !ok2 || port <= 0 || port > 0xffff {
+		return fmt.Errorf("invalid node: %v", pair)
+	}
+	*n = dhtNode(net.JoinHostPort(host, strconv.Itoa(port)))
+	return nil
+}
+
+// urlList is the url-list of a torrent, which is either a single URL or a
+// list of them.
+type urlList []string
+
+func (ul *urlList) UnmarshalBencode(b []byte) error {
+	if len(b) > 0 && b[0] == 'l' {
+		var urls []string
+		if err := bencode.Unmarshal(b, &urls); err != nil {
+			return err
+		}
+		*ul = urls
+		return nil
+	}
+
+	var url string
+	if err := bencode.Unmarshal(b, &url); err != nil {
+		return err
+	}
+	if url != "" {
+		*ul = urlList{url}
+	}
+	return nil
 }
 
 type file struct {
 	Length int      `bencode:"length"`
 	Path   []string `bencode:"path"`
+	// Attr holds the file attributes (BEP 47), "p" for padding files.
+	Attr string `bencode:"attr,omitempty"`
 }
 
 type bencodeInfo struct {
-	Name   string `bencode:"name"`
-	Length int    `bencode:"length"`
-	// Files       *[]file `bencode:"files"`
+	Name        string `bencode:"name"`
+	Length      int    `bencode:"length,omitempty"`
+	Files       []file `bencode:"files,omitempty"`
 	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-	// Private     int    `bencode:"private"`
+	Pieces      string `bencode:"pieces,omitempty"`
+	Private     int    `bencode:"private,omitempty"`
+	// MetaVersion is 2 for v2 and hybrid torrents, which describe their
+	// files in FileTree (BEP 52).
+	MetaVersion int            `bencode:"meta version,omitempty"`
+	FileTree    map[string]any `bencode:"file tree,omitempty"`
+	// Source distinguishes otherwise identical torrents, e.g. of different
+	// private trackers.
+	Source string `bencode:"source,omitempty"`
 }
 
-func (i bencodeInfo) hash() ([20]byte, error) {
-	buf, err := bencode.Marshal(i)
-	if err != nil {
-		return [20]byte{}, err
+func (info *bencodeInfo) mode() infoMode {
+	if info.Files != nil {
+		return multifile
 	}
-	return sha1.Sum(buf), nil
+	return singlefile
+}
+
+// layout returns files in the order in which they are laid out in the torrent
+// data, along with their absolute byte offsets.
+func (info *bencodeInfo) layout() ([]File, int, error) {
+	if info.mode() == singlefile {
+		if info.Length < 0 {
+			return nil, 0, fmt.Errorf("invalid length: %d", info.Length)
+		}
+		return []File{{Path: []string{info.Name}, Length: info.Length}}, info.Length, nil
+	}
+
+	if len(info.Files) == 0 {
+		return nil, 0, errors.New("multifile torrent has no files")
+	}
+
+	files := make([]File, len(info.Files))
+	offset := 0
+
+	for i, f := range info.Files {
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("invalid length for file %d: %d", i, f.Length)
+		}
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("empty path for file %d", i)
+		}
+		for _, seg := range f.Path {
+			if !validPathSegment(seg) {
+				return nil, 0, fmt.Errorf("invalid path segment for file %d: %q", i, seg)
+			}
+		}
+
+		path := make([]string, 0, len(f.Path)+1)
+		path = append(path, info.Name)
+		path = append(path, f.Path...)
+
+		files[i] = File{Path: path, Length: f.Length, Offset: offset, Padding: strings.Contains(f.Attr, "p")}
+		offset += f.Length
+	}
+
+	return files, offset, nil
+}
+
+// validPathSegment reports whether seg can be used as a file or directory
+// name without escaping the torrent's directory.
+func validPathSegment(seg string) bool {
+	return seg != "" && seg != "." && seg != ".." && !strings.ContainsAny(seg, "/\\")
 }
 
 func (info *bencodeInfo) readPieces() ([][20]byte, error) {
 	buf := []byte(info.Pieces)
 
 	if len(buf)%sha1.Size != 0 {
-		return nil, errors.New("")
+		return nil, fmt.Errorf("pieces length is not a multiple of %d: %d", sha1.Size, len(buf))
 	}
 
 	numPieces := len(info.Pieces) / sha1.Size
@@ -63,22 +179,103 @@ func (info *bencodeInfo) readPieces() ([][20]byte, error) {
 }
 
 func (bto *bencodeTorrent) toTorrentFile() (*TorrentFile, error) {
-	pieces, err := bto.Info.readPieces()
+	if len(bto.Info) == 0 {
+		return nil, errors.New("missing info dictionary")
+	}
+
+	tf, err := parseInfo(bto.Info, bto.PieceLayers)
 	if err != nil {
 		return nil, err
 	}
 
-	hash, err := bto.Info.hash()
+	tf.Announce = bto.Announce
+	tf.AnnounceList = bto.AnnounceList
+	for _, n := range bto.Nodes {
+		tf.Nodes = append(tf.Nodes, string(n))
+	}
+	tf.WebSeeds = bto.URLList
+	tf.HTTPSeeds = bto.HTTPSeeds
+
+	return tf, nil
+}
+
+// parseInfo builds a TorrentFile from the raw bencoded info dictionary and,
+// for v2 torrents, the piece layers. The info-hash is the SHA-1 of raw
+// itself, or the truncated SHA-256 for v2 torrents without v1 pieces.
+func parseInfo(raw []byte, layers map[string]string) (*TorrentFile, error) {
+	var info bencodeInfo
+	if err := bencode.Unmarshal(raw, &info); err != nil {
+		return nil, err
+	}
+
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length: %d", info.PieceLength)
+	}
+	// the name is the file of single-file torrents and the directory of the
+	// others
+	if !validPathSegment(info.Name) {
+		return nil, fmt.Errorf("invalid name: %q", info.Name)
+	}
+
+	tf := &TorrentFile{
+		mode:        info.mode(),
+		Name:        info.Name,
+		PieceLength: info.PieceLength,
+		Private:     info.Private == 1,
+		infoBytes:   raw,
+	}
+
+	switch info.MetaVersion {
+	case 0, 1:
+	case 2:
+		files, length, pieces, err := info.layoutV2(layers)
+		// hybrid torrents can do with their v1 pieces alone
+		if err != nil && !(errors.Is(err, errNoPieceLayers) && info.Pieces != "") {
+			return nil, err
+		}
+		tf.Files = files
+		tf.Length = length
+		tf.piecesV2 = pieces
+		tf.InfoHashV2 = sha256.Sum256(raw)
+		copy(tf.InfoHash[:], tf.InfoHashV2[:])
+		tf.mode = multifile
+		if len(files) == 1 && len(files[0].Path) == 1 {
+			tf.mode = singlefile
+		}
+		if info.Pieces == "" {
+			return tf, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported meta version: %d", info.MetaVersion)
+	}
+
+	pieces, err := info.readPieces()
+	if err != nil {
+		return nil, err
+	}
+
+	files, length, err := info.layout()
 	if err != nil {
 		return nil, err
 	}
 
-	return &TorrentFile{
-		Announce:    bto.Announce,
-		Name:        bto.Info.Name,
-		Length:      bto.Info.Length,
-		PieceLength: bto.Info.PieceLength,
-		InfoHash:    hash,
-		Pieces:      pieces,
-	}, nil
+	if want := (length + info.PieceLength - 1) / info.PieceLength; want != len(pieces) {
+		return nil, fmt.Errorf("piece count mismatch: have %d hashes, expected %d", len(pieces), want)
+	}
+
+	if info.MetaVersion == 2 {
+		if !sameFiles(files, tf.Files) {
+			return nil, errors.New("v1 and v2 files of hybrid torrent differ")
+		}
+		if tf.piecesV2 != nil && len(tf.piecesV2) != len(pieces) {
+			return nil, fmt.Errorf("piece count mismatch: have %d v2 pieces, expected %d", len(tf.piecesV2), len(pieces))
+		}
+	}
+
+	tf.Files = files
+	tf.Length = length
+	tf.Pieces = pieces
+	tf.InfoHash = sha1.Sum(raw)
+	tf.mode = info.mode()
+	return tf, nil
 }
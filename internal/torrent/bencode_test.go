@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFile_InfoHash(t *testing.T) {
+	d, err := NewFile("../../file4.torrent")
+	require.NoError(t, err)
+
+	tf := d.(*TorrentFile)
+	require.Equal(t, "c9e15763f722f23e98a29decdfae341b98d53056", hex.EncodeToString(tf.InfoHash[:]))
+	require.True(t, tf.IsMultiFile())
+	require.Len(t, tf.Files, 6)
+}
+
+func TestParseInfo_KeepsUnmodeledKeys(t *testing.T) {
+	// "private" and "source" aren't modeled by bencodeInfo and the keys are
+	// not sorted, so re-encoding the struct would yield a different hash.
+	raw := "d4:name1:a6:lengthi1e12:piece lengthi1e6:pieces20:" + string(make([]byte, 20)) + "7:privatei1e6:source3:fooe"
+
+	tf, err := parseInfo([]byte(raw), nil)
+	require.NoError(t, err)
+	require.Equal(t, sha1.Sum([]byte(raw)), tf.InfoHash)
+}
+
+func TestToTorrentFile_Nodes(t *testing.T) {
+	raw := "d5:nodesll9:127.0.0.1i6881eel7:2001::1i80eee4:infod4:name1:a6:lengthi1e12:piece lengthi1e6:pieces20:" + string(make([]byte, 20)) + "ee"
+
+	var src bencodeTorrent
+	require.NoError(t, bencode.Unmarshal([]byte(raw), &src))
+
+	tf, err := src.toTorrentFile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.1:6881", "[2001::1]:80"}, tf.Nodes)
+
+	require.Error(t, bencode.Unmarshal([]byte("d5:nodesll9:127.0.0.1i0eeee"), &src))
+}
+
+func TestURLList(t *testing.T) {
+	var src bencodeTorrent
+	require.NoError(t, bencode.Unmarshal([]byte("d8:url-list9:http://a/e"), &src))
+	require.Equal(t, urlList{"http://a/"}, src.URLList)
+
+	src = bencodeTorrent{}
+	require.NoError(t, bencode.Unmarshal([]byte("d8:url-listl9:http://a/9:http://b/ee"), &src))
+	require.Equal(t, urlList{"http://a/", "http://b/"}, src.URLList)
+
+	src = bencodeTorrent{}
+	require.NoError(t, bencode.Unmarshal([]byte("d8:url-list0:e"), &src))
+	require.Nil(t, src.URLList)
+}
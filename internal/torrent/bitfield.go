@@ -0,0 +1,54 @@
+package torrent
+
+// bitfield is the set of pieces a peer has, most significant bit first.
+type bitfield []byte
+
+func newBitfield(numPieces int) bitfield {
+	return make(bitfield, (numPieces+7)/8)
+}
+
+func (bf bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-index%8)&1 != 0
+}
+
+func (bf bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - index%8)
+}
+
+func (bf bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - index%8)
+}
+
+// and returns the pieces in both bf and other.
+func (bf bitfield) and(other bitfield) bitfield {
+	out := make(bitfield, len(bf))
+	for i := range out {
+		if i < len(other) {
+			out[i] = bf[i] & other[i]
+		}
+	}
+	return out
+}
+
+// andNot returns the pieces in bf but not in other.
+func (bf bitfield) andNot(other bitfield) bitfield {
+	out := append(bitfield(nil), bf...)
+	for i := range out {
+		if i < len(other) {
+			out[i] &^= other[i]
+		}
+	}
+	return out
+}
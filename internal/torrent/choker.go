@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// rechokeInterval is how often the choker reconsiders which peers to
+	// upload to.
+	rechokeInterval = 10 * time.Second
+	// optimisticRounds is the number of rechoke rounds an optimistic unchoke
+	// lasts, i.e. it rotates every 30 seconds.
+	optimisticRounds = 3
+	// unchokeSlots is the number of peers unchoked for their rates, on top
+	// of the optimistic unchoke.
+	unchokeSlots = 4
+	// snubTimeout is how long a peer may go without sending us a block
+	// before it loses its regular unchoke slot.
+	snubTimeout = time.Minute
+)
+
+// choker implements tit-for-tat: it unchokes the interested peers we
+// download from fastest, or upload to fastest once we are seeding. One more
+// peer is unchoked optimistically, so new peers get a chance to prove
+// themselves. Peers that snub us only get the optimistic slot.
+type choker struct {
+	slots   int
+	conns   func() []*peerConn
+	seeding func() bool
+
+	mu         sync.Mutex
+	round      int
+	optimistic *peerConn
+	// last holds the byte counters of every peer at the previous round.
+	last map[*peerConn]int64
+}
+
+func newChoker(slots int, conns func() []*peerConn, seeding func() bool) *choker {
+	return &choker{
+		slots:   slots,
+		conns:   conns,
+		seeding: seeding,
+		last:    make(map[*peerConn]int64),
+	}
+}
+
+func (c *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.rechoke()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// interested unchokes a peer that became interested right away if a slot is
+// free, rather than making it wait for the next round.
+func (c *choker) interested(pc *peerConn) {
+	c.mu.Lock()
+	unchoked := 0
+	for _, other := range c.conns() {
+		if !other.isChoked() {
+			unchoked++
+		}
+	}
+	changed := unchoked < c.slots+1 && pc.setChoked(false)
+	c.mu.Unlock()
+
+	if changed {
+		pc.sendChoke()
+	}
+}
+
+// rechoke decides which peers to unchoke and then tells the peers whose
+// state changed, without holding the lock while writing to them.
+func (c *choker) rechoke() {
+	for _, pc := range c.update() {
+		pc.sendChoke()
+	}
+}
+
+// update chokes and unchokes the peers for a new round and returns those
+// whose state changed.
+func (c *choker) update() []*peerConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conns := c.conns()
+	seeding := c.seeding()
+
+	// shuffle so that peers with equal rates are picked at random
+	rand.Shuffle(len(conns), func(i, j int) { conns[i], conns[j] = conns[j], conns[i] })
+
+	rates := make(map[*peerConn]int64, len(conns))
+	last := make(map[*peerConn]int64, len(conns))
+	var candidates []*peerConn
+	for _, pc := range conns {
+		total := pc.downloaded.Load()
+		if seeding {
+			total = pc.uploaded.Load()
+		}
+		rates[pc] = total - c.last[pc]
+		last[pc] = total
+
+		if !pc.isInterested() || !seeding && pc.snubbed(snubTimeout) {
+			continue
+		}
+		candidates = append(candidates, pc)
+	}
+	c.last = last
+
+	slices.SortStableFunc(candidates, func(a, b *peerConn) int {
+		switch {
+		case rates[a] > rates[b]:
+			return -1
+		case rates[a] < rates[b]:
+			return 1
+		}
+		return 0
+	})
+
+	unchoke := make(map[*peerConn]bool)
+	for _, pc := range candidates[:min(c.slots, len(candidates))] {
+		unchoke[pc] = true
+	}
+
+	if c.round%optimisticRounds == 0 || !slices.Contains(conns, c.optimistic) || unchoke[c.optimistic] {
+		c.optimistic = nil
+		for _, pc := range conns {
+			if !unchoke[pc] && pc.isInterested() {
+				c.optimistic = pc
+				break
+			}
+		}
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+	c.round++
+
+	var changed []*peerConn
+	for _, pc := range conns {
+		if pc.setChoked(!unchoke[pc]) {
+			changed = append(changed, pc)
+		}
+	}
+	return changed
+}
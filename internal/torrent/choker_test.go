@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newInterestedConns returns n choked connections to interested peers.
+func newInterestedConns(t *testing.T, n int) []*peerConn {
+	t.Helper()
+
+	conns := make([]*peerConn, n)
+	for i := range conns {
+		pc, _ := newConnPair(t)
+		pc.peer.Choked = true
+		pc.interested = true
+		pc.lastBlock.Store(time.Now().UnixNano())
+		conns[i] = pc
+	}
+	return conns
+}
+
+func unchokedConns(conns []*peerConn) []*peerConn {
+	var unchoked []*peerConn
+	for _, pc := range conns {
+		if !pc.isChoked() {
+			unchoked = append(unchoked, pc)
+		}
+	}
+	return unchoked
+}
+
+func TestChoker_UnchokesFastestPeers(t *testing.T) {
+	conns := newInterestedConns(t, 8)
+	for i, pc := range conns {
+		pc.downloaded.Store(int64(i * 1000))
+	}
+	// the fastest peer snubs us and loses its regular slot
+	conns[7].lastBlock.Store(time.Now().Add(-2 * snubTimeout).UnixNano())
+	// a fast peer that isn't interested doesn't need a slot
+	conns[6].interested = false
+
+	c := newChoker(4, func() []*peerConn { return append([]*peerConn(nil), conns...) }, func() bool { return false })
+	c.rechoke()
+
+	unchoked := unchokedConns(conns)
+	require.Len(t, unchoked, 5)
+	for _, pc := range conns[2:6] {
+		require.False(t, pc.isChoked())
+	}
+	// the optimistic unchoke goes to any other interested peer
+	require.Contains(t, []*peerConn{conns[0], conns[1], conns[7]}, c.optimistic)
+	require.True(t, conns[6].isChoked())
+}
+
+func TestChoker_SeedingUsesUploadRate(t *testing.T) {
+	conns := newInterestedConns(t, 3)
+	conns[0].uploaded.Store(500)
+	conns[1].downloaded.Store(500)
+
+	c := newChoker(1, func() []*peerConn { return append([]*peerConn(nil), conns...) }, func() bool { return true })
+	c.rechoke()
+
+	require.False(t, conns[0].isChoked())
+	require.NotEqual(t, conns[0], c.optimistic)
+}
+
+func TestChoker_RotatesOptimisticUnchoke(t *testing.T) {
+	conns := newInterestedConns(t, 6)
+	c := newChoker(0, func() []*peerConn { return append([]*peerConn(nil), conns...) }, func() bool { return false })
+
+	seen := make(map[*peerConn]bool)
+	for range 20 * optimisticRounds {
+		c.rechoke()
+		require.Len(t, unchokedConns(conns), 1)
+		seen[c.optimistic] = true
+	}
+	require.Greater(t, len(seen), 1)
+}
+
+func TestChoker_InterestedUsesFreeSlot(t *testing.T) {
+	conns := newInterestedConns(t, 3)
+	c := newChoker(1, func() []*peerConn { return append([]*peerConn(nil), conns...) }, func() bool { return false })
+
+	c.interested(conns[0])
+	c.interested(conns[1])
+	c.interested(conns[2])
+
+	// one regular and one optimistic slot
+	require.Len(t, unchokedConns(conns), 2)
+}
+
+func TestChoker_SendsWithoutLock(t *testing.T) {
+	conns := newInterestedConns(t, 2)
+	// writes to a pipe block until the other end reads, which it never does
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conns[0].conn = a
+
+	c := newChoker(1, func() []*peerConn { return append([]*peerConn(nil), conns...) }, func() bool { return false })
+	go c.rechoke()
+
+	require.Eventually(t, func() bool {
+		if !c.mu.TryLock() {
+			return false
+		}
+		defer c.mu.Unlock()
+		return !conns[0].isChoked()
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,214 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"test/pkg/bencode"
+	"time"
+)
+
+const (
+	minPieceLength = 16 << 10
+	maxPieceLength = 16 << 20
+	// targetPieces is the piece count an automatic piece length aims for:
+	// fewer pieces make a smaller .torrent, more make finer-grained trading.
+	targetPieces = 1500
+)
+
+// Builder creates .torrent files.
+type Builder struct {
+	// PieceLength is the size of a piece, a power of two. If zero it is
+	// chosen from the total size.
+	PieceLength int
+	// Name is the name of the torrent, the base name of the path if empty.
+	Name string
+	// AnnounceList are the tracker tiers. The first tracker is also written
+	// as the announce URL.
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate defaults to the current time.
+	CreationDate time.Time
+	Private      bool
+	Source       string
+	// URLList are web seed URLs (BEP 19).
+	URLList []string
+}
+
+// autoPieceLength returns the smallest power of two piece length that keeps
+// the piece count of length bytes around targetPieces.
+func autoPieceLength(length int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Build hashes the file or directory at path and returns the bencoded
+// torrent. Directories are walked in lexical order; anything but regular
+// files is skipped.
+func (b *Builder) Build(ctx context.Context, path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the layout reads files relative to the parent directory, with the
+	// base name of path as the first path segment
+	base := filepath.Base(path)
+	tf := &TorrentFile{}
+	info := bencodeInfo{Name: b.Name, Source: b.Source}
+	if info.Name == "" {
+		info.Name = base
+	}
+	if b.Private {
+		info.Private = 1
+	}
+
+	if fi.IsDir() {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			segs := strings.Split(filepath.ToSlash(rel), "/")
+			info.Files = append(info.Files, file{Length: int(fi.Size()), Path: segs})
+			tf.Files = append(tf.Files, File{
+				Path:   append([]string{base}, segs...),
+				Length: int(fi.Size()),
+				Offset: tf.Length,
+			})
+			tf.Length += int(fi.Size())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("%s: no files", path)
+		}
+	} else {
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s: not a regular file", path)
+		}
+		info.Length = int(fi.Size())
+		tf.Files = []File{{Path: []string{base}, Length: info.Length}}
+		tf.Length = info.Length
+	}
+	if tf.Length == 0 {
+		return nil, fmt.Errorf("%s: no data", path)
+	}
+
+	tf.PieceLength = b.PieceLength
+	if tf.PieceLength == 0 {
+		tf.PieceLength = autoPieceLength(tf.Length)
+	}
+	if tf.PieceLength <= 0 || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length is not a power of two: %d", tf.PieceLength)
+	}
+	info.PieceLength = tf.PieceLength
+
+	st, err := FileStorage{Dir: filepath.Dir(path)}.Open(tf)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	if err := tf.hashPieces(ctx, st); err != nil {
+		return nil, err
+	}
+	pieces := make([]byte, 0, len(tf.Pieces)*sha1.Size)
+	for _, hash := range tf.Pieces {
+		pieces = append(pieces, hash[:]...)
+	}
+	info.Pieces = string(pieces)
+
+	raw, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	date := b.CreationDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	bto := bencodeTorrent{
+		AnnounceList: b.AnnounceList,
+		CreationDate: date.Unix(),
+		Comment:      b.Comment,
+		CreatedBy:    b.CreatedBy,
+		URLList:      b.URLList,
+		Info:         raw,
+	}
+	if len(b.AnnounceList) > 0 && len(b.AnnounceList[0]) > 0 {
+		bto.Announce = b.AnnounceList[0][0]
+	}
+	if len(b.AnnounceList) == 1 && len(b.AnnounceList[0]) == 1 {
+		// a single tracker needs no announce-list
+		bto.AnnounceList = nil
+	}
+
+	return bencode.Marshal(bto)
+}
+
+// hashPieces fills Pieces with the hashes of the data in st, hashed in
+// parallel.
+func (tf *TorrentFile) hashPieces(ctx context.Context, st TorrentStorage) error {
+	tf.Pieces = make([][20]byte, (tf.Length+tf.PieceLength-1)/tf.PieceLength)
+	indexes := make(chan int)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		readErr error
+	)
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				buf := make([]byte, tf.pieceSize(index))
+				if err := st.ReadAt(buf, index, 0); err != nil {
+					mu.Lock()
+					if readErr == nil {
+						readErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				tf.Pieces[index] = sha1.Sum(buf)
+			}
+		}()
+	}
+
+	var err error
+	for index := range tf.Pieces {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	return readErr
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func parseTorrent(t *testing.T, buf []byte) (*bencodeTorrent, *TorrentFile) {
+	t.Helper()
+
+	var bto bencodeTorrent
+	require.NoError(t, bencode.Unmarshal(buf, &bto))
+	tf, err := bto.toTorrentFile()
+	require.NoError(t, err)
+	return &bto, tf
+}
+
+func TestBuilder_Directory(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "data")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "b.txt"), bytes.Repeat([]byte("b"), 40000), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), bytes.Repeat([]byte("a"), 10), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sub", "c.txt"), bytes.Repeat([]byte("c"), 30000), 0o644))
+
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := &Builder{
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		Comment:      "nightly",
+		CreatedBy:    "client/1.0",
+		CreationDate: date,
+		Private:      true,
+		Source:       "ci",
+		URLList:      []string{"https://mirror/"},
+	}
+	buf, err := b.Build(context.Background(), root)
+	require.NoError(t, err)
+
+	bto, tf := parseTorrent(t, buf)
+	require.Equal(t, "http://a/announce", bto.Announce)
+	require.Equal(t, b.AnnounceList, bto.AnnounceList)
+	require.Equal(t, "nightly", bto.Comment)
+	require.Equal(t, "client/1.0", bto.CreatedBy)
+	require.Equal(t, date.Unix(), bto.CreationDate)
+	require.Equal(t, urlList{"https://mirror/"}, bto.URLList)
+
+	require.Equal(t, "data", tf.Name)
+	require.True(t, tf.IsMultiFile())
+	require.True(t, tf.Private)
+	require.Equal(t, minPieceLength, tf.PieceLength)
+	require.Equal(t, []File{
+		{Path: []string{"data", "a.txt"}, Length: 10, Offset: 0},
+		{Path: []string{"data", "b.txt"}, Length: 40000, Offset: 10},
+		{Path: []string{"data", "sub", "c.txt"}, Length: 30000, Offset: 40010},
+	}, tf.Files)
+
+	tf.Storage = FileStorage{Dir: parent}
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+
+	// the source is part of the info dictionary, so it changes the info-hash
+	b.Source = "other"
+	buf, err = b.Build(context.Background(), root)
+	require.NoError(t, err)
+	_, other := parseTorrent(t, buf)
+	require.NotEqual(t, tf.InfoHash, other.InfoHash)
+}
+
+func TestBuilder_SingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.bin")
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	buf, err := (&Builder{PieceLength: 32, AnnounceList: [][]string{{"http://a/announce"}}}).Build(context.Background(), path)
+	require.NoError(t, err)
+
+	bto, tf := parseTorrent(t, buf)
+	require.Equal(t, "http://a/announce", bto.Announce)
+	require.Nil(t, bto.AnnounceList)
+	require.False(t, tf.IsMultiFile())
+	require.Equal(t, len(data), tf.Length)
+	require.Equal(t, 32, tf.PieceLength)
+	require.Len(t, tf.Pieces, 4)
+
+	tf.Storage = FileStorage{Dir: dir}
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+
+	_, err = (&Builder{PieceLength: 100}).Build(context.Background(), path)
+	require.Error(t, err)
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	require.Equal(t, minPieceLength, autoPieceLength(1))
+	require.Equal(t, 1<<20, autoPieceLength(1<<30))
+	require.Equal(t, maxPieceLength, autoPieceLength(1<<45))
+}
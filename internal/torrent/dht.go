@@ -0,0 +1,45 @@
+package torrent
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"test/internal/dht"
+	"time"
+)
+
+// dhtAnnounceInterval is how often a download announces itself to the DHT.
+const dhtAnnounceInterval = 15 * time.Minute
+
+func dhtPeers(addrs []netip.AddrPort) []Peer {
+	peers := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = Peer{IP: addr.Addr().String(), Port: addr.Port()}
+	}
+	return peers
+}
+
+// runDHT announces the torrent to the DHT until ctx is cancelled, passing
+// the peers found along the way to addPeers.
+func (s *session) runDHT(ctx context.Context, d *dht.Server) {
+	if err := d.Bootstrap(ctx, s.tf.Nodes...); err != nil {
+		log.Printf("dht bootstrap failed: %v", err)
+	}
+
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		peers, err := d.Announce(ctx, dht.ID(s.tf.InfoHash), s.port)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("dht announce failed: %v", err)
+		}
+		s.addPeers(dhtPeers(peers))
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
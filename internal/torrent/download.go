@@ -0,0 +1,845 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxBlockSize is the largest number of bytes a request can ask for.
+	maxBlockSize = 16384
+	// maxBacklog is the number of unfulfilled requests a client can have in
+	// its pipeline.
+	maxBacklog = 5
+	// maxRequestLength is the largest block we serve to a peer.
+	maxRequestLength = 128 * 1024
+	// peerIdleTimeout is how long a peer may stay silent. Peers send
+	// keep-alives every two minutes.
+	peerIdleTimeout = 3 * time.Minute
+	// peerWriteTimeout bounds every write to a peer, so one that stops
+	// reading can't hold up whoever is sending to it.
+	peerWriteTimeout = 30 * time.Second
+	// maxPeerConns is the number of peers a session is connected to at once.
+	maxPeerConns = 50
+	// maxPendingPeers is the number of peers waiting for a connection slot;
+	// more are dropped until the queue drains.
+	maxPendingPeers = 1000
+)
+
+type pieceWork struct {
+	index  int
+	length int
+}
+
+type pieceResult struct {
+	index int
+	buf   []byte
+}
+
+type pieceProgress struct {
+	index      int
+	buf        []byte
+	downloaded int
+	backlog    int
+	requested  []bool
+	received   []bool
+}
+
+func newPieceProgress(pw *pieceWork) *pieceProgress {
+	numBlocks := (pw.length + maxBlockSize - 1) / maxBlockSize
+	return &pieceProgress{
+		index:     pw.index,
+		buf:       make([]byte, pw.length),
+		requested: make([]bool, numBlocks),
+		received:  make([]bool, numBlocks),
+	}
+}
+
+func (state *pieceProgress) readMessage(pc *peerConn) error {
+	msg, err := pc.read()
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
+	}
+
+	if err := pc.handle(msg); err != nil {
+		return err
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		// requests pending at a choke are discarded by the peer, which with
+		// the fast extension rejects them instead
+		if pc.fast {
+			return nil
+		}
+		for i := range state.requested {
+			state.requested[i] = state.received[i]
+		}
+		state.backlog = 0
+	case MsgReject:
+		req, err := ParseReject(msg)
+		if err != nil {
+			return err
+		}
+		block := req.Begin / maxBlockSize
+		if req.Index != state.index || req.Begin%maxBlockSize != 0 || block >= len(state.requested) {
+			return nil
+		}
+		if !state.requested[block] || state.received[block] {
+			return nil
+		}
+		state.requested[block] = false
+		state.backlog--
+		// a request we may make right now is one the peer won't serve
+		if pc.canRequest(state.index) {
+			return errPieceRejected
+		}
+	case MsgPiece:
+		index, begin, data, err := ParsePiece(msg)
+		if err != nil {
+			return err
+		}
+		if index != state.index {
+			return fmt.Errorf("expected piece %d, got %d", state.index, index)
+		}
+		if begin < 0 || begin+len(data) > len(state.buf) {
+			return fmt.Errorf("block [%d, %d) out of piece bounds %d", begin, begin+len(data), len(state.buf))
+		}
+		block := begin / maxBlockSize
+		if begin%maxBlockSize != 0 || state.received[block] {
+			return nil
+		}
+		copy(state.buf[begin:], data)
+		state.received[block] = true
+		state.downloaded += len(data)
+		pc.downloaded.Add(int64(len(data)))
+		pc.lastBlock.Store(time.Now().UnixNano())
+		if state.requested[block] {
+			state.backlog--
+		}
+	}
+
+	return nil
+}
+
+func (state *pieceProgress) sendRequests(pc *peerConn) error {
+	for block := range state.requested {
+		if state.backlog >= maxBacklog {
+			break
+		}
+		if state.requested[block] {
+			continue
+		}
+
+		begin := block * maxBlockSize
+		length := min(maxBlockSize, len(state.buf)-begin)
+		if err := pc.send(NewRequest(state.index, begin, length)); err != nil {
+			return err
+		}
+
+		state.requested[block] = true
+		state.backlog++
+	}
+	return nil
+}
+
+// cancelRequests withdraws the requests still outstanding, e.g. once the
+// piece was completed by another peer during endgame.
+func (state *pieceProgress) cancelRequests(pc *peerConn) error {
+	for block := range state.requested {
+		if !state.requested[block] || state.received[block] {
+			continue
+		}
+		begin := block * maxBlockSize
+		length := min(maxBlockSize, len(state.buf)-begin)
+		if err := pc.send(NewCancel(state.index, begin, length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errPieceDone is returned by attemptDownloadPiece when another peer
+// completed the piece first.
+var errPieceDone = errors.New("piece completed by another peer")
+
+// attemptDownloadPiece downloads a whole piece from the peer. If done is set,
+// the download is abandoned once it reports the piece as completed.
+func attemptDownloadPiece(pc *peerConn, pw *pieceWork, done func(index int) bool) ([]byte, error) {
+	state := newPieceProgress(pw)
+
+	// a generous deadline that gets us unstuck from unresponsive peers;
+	// writes have their own, see send
+	pc.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer pc.conn.SetReadDeadline(time.Time{})
+
+	for state.downloaded < pw.length {
+		if done != nil && done(pw.index) {
+			if err := state.cancelRequests(pc); err != nil {
+				return nil, err
+			}
+			return nil, errPieceDone
+		}
+
+		if pc.canRequest(pw.index) {
+			if err := state.sendRequests(pc); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := state.readMessage(pc); err != nil {
+			if errors.Is(err, errPieceRejected) {
+				if err := state.cancelRequests(pc); err != nil {
+					return nil, err
+				}
+			}
+			return nil, err
+		}
+	}
+
+	return state.buf, nil
+}
+
+func (tf *TorrentFile) checkIntegrity(index int, buf []byte) error {
+	if !tf.checkHash(index, buf) {
+		return fmt.Errorf("piece %d failed integrity check", index)
+	}
+	return nil
+}
+
+// session is the state of a single torrent: the pieces left to fetch and
+// the peers fetching them or being served.
+type session struct {
+	tf         *TorrentFile
+	clientID   [20]byte
+	port       uint16
+	extensions *ExtensionRegistry
+	pex        *pexExtension
+	picker     *picker
+	choker     *choker
+	trackers   *TrackerList
+	results    chan *pieceResult
+	storage    TorrentStorage
+
+	mu     sync.Mutex
+	known  map[string]bool
+	conns  map[*peerConn]bool
+	have   bitfield
+	active int
+	// maxConns limits peerConns, the number of peer workers. Peers beyond it
+	// wait in pending.
+	maxConns  int
+	peerConns int
+	pending   []Peer
+	// idle receives a value whenever the last active worker exits.
+	idle chan struct{}
+	// done is closed once the session stops, releasing all workers.
+	done chan struct{}
+
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	left       atomic.Int64
+}
+
+// newSession returns a session that keeps the torrent data in st and fetches
+// the pieces missing from have, which may be nil.
+func newSession(tf *TorrentFile, clientID [20]byte, port uint16, st TorrentStorage, have bitfield) *session {
+	if have == nil {
+		have = newBitfield(tf.numPieces())
+	}
+
+	s := &session{
+		tf:         tf,
+		clientID:   clientID,
+		port:       port,
+		extensions: NewExtensionRegistry(),
+		picker:     newPicker(tf.numPieces(), have),
+		trackers:   NewTrackerList(tf.trackerTiers()),
+		results:    make(chan *pieceResult),
+		storage:    st,
+		known:      make(map[string]bool),
+		conns:      make(map[*peerConn]bool),
+		have:       have,
+		maxConns:   maxPeerConns,
+		idle:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	s.choker = newChoker(unchokeSlots, s.connections, func() bool { return s.left.Load() == 0 })
+	s.extensions.Register(&metadataExtension{info: tf.infoBytes})
+	if !tf.Private {
+		s.pex = newPexExtension(s.addPeers)
+		s.extensions.Register(s.pex)
+	}
+
+	for index := range tf.numPieces() {
+		if !have.HasPiece(index) {
+			s.left.Add(int64(tf.pieceSize(index)))
+		}
+	}
+
+	return s
+}
+
+func (s *session) stats() TransferStats {
+	return TransferStats{
+		Uploaded:   s.uploaded.Load(),
+		Downloaded: s.downloaded.Load(),
+		Left:       s.left.Load(),
+	}
+}
+
+// addPeers starts a worker for every peer that isn't known yet, or queues
+// it until a connection slot is free.
+func (s *session) addPeers(peers []Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return
+	}
+
+	for _, peer := range peers {
+		addr := peer.addr()
+		if s.known[addr] {
+			continue
+		}
+		switch {
+		case s.peerConns < s.maxConns:
+			s.startPeer(peer)
+		case len(s.pending) < maxPendingPeers:
+			s.pending = append(s.pending, peer)
+		default:
+			// left unknown, so it can be added again once there is room
+			continue
+		}
+		s.known[addr] = true
+	}
+}
+
+// startPeer starts a worker connecting to the peer. s.mu must be held.
+func (s *session) startPeer(peer Peer) {
+	s.active++
+	s.peerConns++
+
+	go func() {
+		defer s.peerDone()
+		s.downloadWorker(peer)
+	}()
+}
+
+// peerDone frees the connection slot of an exited peer worker, handing it
+// to the next pending peer.
+func (s *session) peerDone() {
+	s.mu.Lock()
+	s.peerConns--
+	if len(s.pending) > 0 && !s.isClosed() {
+		peer := s.pending[0]
+		s.pending = s.pending[1:]
+		s.startPeer(peer)
+	}
+	s.mu.Unlock()
+
+	s.workerDone()
+}
+
+// addConn starts a worker for an established connection, e.g. one accepted
+// by a Listener. The connection is closed if there is no free slot.
+func (s *session) addConn(pc *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() || s.peerConns >= s.maxConns {
+		pc.conn.Close()
+		return
+	}
+
+	s.known[pc.peer.addr()] = true
+	s.active++
+	s.peerConns++
+
+	go func() {
+		defer s.peerDone()
+		s.runConn(pc)
+	}()
+}
+
+func (s *session) workerDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.active == 0 {
+		select {
+		case s.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *session) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the session and closes every connection, so workers blocked
+// reading from their peer return.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isClosed() {
+		close(s.done)
+	}
+	for pc := range s.conns {
+		pc.conn.Close()
+	}
+}
+
+// track sends the connection our bitfield, which has to be the first
+// message after the handshake, and registers it for have broadcasts. Peers
+// with the fast extension get have all or have none instead where they
+// apply. It returns false if the session is closed.
+func (s *session) track(pc *peerConn) bool {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return false
+	}
+	have := append(bitfield(nil), s.have...)
+	s.mu.Unlock()
+
+	count := 0
+	for i := range s.tf.numPieces() {
+		if have.HasPiece(i) {
+			count++
+		}
+	}
+	switch {
+	case pc.fast && count == 0:
+		pc.send(NewHaveNone())
+	case pc.fast && count == s.tf.numPieces():
+		pc.send(NewHaveAll())
+	case count > 0:
+		pc.send(NewBitfield(have))
+	}
+
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return false
+	}
+	s.conns[pc] = true
+	missed := s.have.andNot(have)
+	s.mu.Unlock()
+
+	// pieces verified while the bitfield was sent
+	for i := range s.tf.numPieces() {
+		if missed.HasPiece(i) {
+			pc.send(NewHave(i))
+		}
+	}
+	return true
+}
+
+func (s *session) connections() []*peerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*peerConn, 0, len(s.conns))
+	for pc := range s.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+func (s *session) untrack(pc *peerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, pc)
+}
+
+func (s *session) hasPiece(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.have.HasPiece(index)
+}
+
+// markHave records a verified piece and tells every connected peer about it.
+// The haves are sent in the background, so a peer that doesn't read holds up
+// neither the caller nor the other peers.
+func (s *session) markHave(index int) {
+	s.mu.Lock()
+	s.have.SetPiece(index)
+	s.mu.Unlock()
+
+	msg := NewHave(index)
+	for _, pc := range s.connections() {
+		go pc.send(msg)
+	}
+}
+
+// errPieceUnavailable is returned by readBlock for pieces we don't have.
+var errPieceUnavailable = errors.New("requested piece is not available")
+
+// readBlock reads a block requested by a peer from a verified piece.
+func (s *session) readBlock(req BlockRequest) ([]byte, error) {
+	if !s.hasPiece(req.Index) {
+		return nil, fmt.Errorf("%w: %d", errPieceUnavailable, req.Index)
+	}
+	if req.Begin < 0 || req.Length <= 0 || req.Length > maxRequestLength || req.Begin+req.Length > s.tf.pieceSize(req.Index) {
+		return nil, fmt.Errorf("invalid request for piece %d: [%d, %d)", req.Index, req.Begin, req.Begin+req.Length)
+	}
+
+	buf := make([]byte, req.Length)
+	if err := s.storage.ReadAt(buf, req.Index, req.Begin); err != nil {
+		return nil, err
+	}
+
+	s.uploaded.Add(int64(len(buf)))
+	return buf, nil
+}
+
+func (s *session) downloadWorker(peer Peer) {
+	pc, err := dialPeer(peer, s.tf.InfoHash, s.clientID, s.tf.numPieces())
+	if err != nil {
+		log.Printf("could not connect to peer %s: %v", peer.addr(), err)
+		return
+	}
+
+	if s.pex != nil {
+		s.pex.addConn(peer)
+		defer s.pex.removeConn(peer)
+	}
+
+	s.runConn(pc)
+}
+
+// runConn downloads pieces from the peer and serves its requests until
+// either side is done.
+func (s *session) runConn(pc *peerConn) {
+	defer pc.close()
+
+	pc.serve = s.readBlock
+	pc.choker = s.choker
+	if !s.track(pc) {
+		return
+	}
+	defer s.untrack(pc)
+
+	pc.picker = s.picker
+
+	if err := s.allowFast(pc); err != nil {
+		return
+	}
+
+	if err := pc.startExtensions(s.extensions, s.port, len(s.tf.infoBytes)); err != nil {
+		return
+	}
+
+	if s.left.Load() > 0 {
+		if err := pc.send(NewInterested()); err != nil {
+			return
+		}
+	}
+
+	for !s.isClosed() {
+		index, ok := s.pickFrom(pc)
+		if !ok {
+			// the peer has nothing we need, serve it until it sends something,
+			// e.g. a have message
+			if err := pc.update(peerIdleTimeout); err != nil {
+				return
+			}
+			continue
+		}
+
+		pw := &pieceWork{index: index, length: s.tf.pieceSize(index)}
+		buf, err := attemptDownloadPiece(pc, pw, s.picker.isDone)
+		if errors.Is(err, errPieceDone) {
+			s.picker.release(index)
+			continue
+		}
+		if errors.Is(err, errPieceRejected) {
+			// a choking peer withdrew the piece from its allowed fast set, an
+			// unchoking one won't serve it at all
+			s.picker.release(index)
+			if pc.choked {
+				pc.allowedFast.ClearPiece(index)
+			} else {
+				pc.rejected.SetPiece(index)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("peer %s: failed to download piece %d: %v", pc.Addr(), index, err)
+			s.picker.release(index)
+			return
+		}
+
+		if err := s.tf.checkIntegrity(index, buf); err != nil {
+			log.Printf("peer %s: %v", pc.Addr(), err)
+			s.picker.release(index)
+			continue
+		}
+
+		if !s.picker.complete(index) {
+			continue
+		}
+
+		select {
+		case s.results <- &pieceResult{index: index, buf: buf}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// run collects verified pieces and writes them to disk until every piece is
+// done, all peers have disconnected or ctx is cancelled.
+func (s *session) run(ctx context.Context, onComplete func()) error {
+	defer s.close()
+
+	done := 0
+	for i := range s.tf.numPieces() {
+		if s.hasPiece(i) {
+			done++
+		}
+	}
+
+	for done < s.tf.numPieces() {
+		select {
+		case res := <-s.results:
+			if err := s.storage.WriteAt(res.buf, res.index, 0); err != nil {
+				return err
+			}
+			if err := s.storage.MarkComplete(res.index); err != nil {
+				return err
+			}
+			done++
+			s.markHave(res.index)
+			s.downloaded.Add(int64(len(res.buf)))
+			s.left.Add(-int64(len(res.buf)))
+			log.Printf("(%0.2f%%) downloaded piece #%d", float64(done)/float64(s.tf.numPieces())*100, res.index)
+		case <-s.idle:
+			// the signal may be stale, e.g. from a peer that left before
+			// the others were added
+			s.mu.Lock()
+			idle := s.active == 0
+			s.mu.Unlock()
+			if idle {
+				return fmt.Errorf("all peers disconnected: downloaded %d of %d pieces", done, s.tf.numPieces())
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	onComplete()
+
+	return nil
+}
+
+// listen registers the session with the torrent's Listener, or with a new
+// one on the session's port. The returned function unregisters it.
+func (s *session) listen() (func(), error) {
+	ln := s.tf.Listener
+	owned := false
+	if ln == nil {
+		var err error
+		ln, err = Listen(fmt.Sprintf(":%d", s.port))
+		if err != nil {
+			return nil, err
+		}
+		owned = true
+	}
+
+	ln.add(s)
+	return func() {
+		ln.remove(s)
+		if owned {
+			ln.Close()
+		}
+	}, nil
+}
+
+// announce registers the torrent with its trackers and, unless it is
+// private, the DHT, and keeps re-announcing in the background until ctx is
+// cancelled. It returns the peers of the first tracker response and the
+// function to call once the download completes.
+func (s *session) announce(ctx context.Context, wg *sync.WaitGroup) ([]Peer, func(), error) {
+	tf := s.tf
+	useDHT := tf.DHT != nil && !tf.Private
+	// without trackers, the DHT or web seeds have to provide the data
+	needTracker := !useDHT && len(tf.WebSeeds) == 0 && len(tf.HTTPSeeds) == 0
+
+	var peers []Peer
+	onComplete := func() {}
+
+	if len(tf.trackerTiers()) > 0 || needTracker {
+		ann := NewAnnouncer(s.trackers, AnnounceRequest{
+			InfoHash: tf.InfoHash,
+			PeerID:   s.clientID,
+			Port:     s.port,
+		}, s.stats)
+
+		startCtx, startCancel := context.WithTimeout(ctx, time.Minute)
+		resp, err := ann.Announce(startCtx, EventStarted)
+		startCancel()
+		switch {
+		case err == nil:
+			peers = resp.AllPeers()
+		case needTracker:
+			return nil, nil, err
+		default:
+			// Run retries, and the tracker list sends started to trackers
+			// that haven't had it
+			log.Printf("tracker announce failed: %v", err)
+		}
+
+		onComplete = ann.Completed
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ann.Run(ctx, s.addPeers)
+		}()
+	}
+
+	if useDHT {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runDHT(ctx, tf.DHT)
+		}()
+	}
+
+	return peers, onComplete, nil
+}
+
+// Download fetches every piece from the swarm, verifies it and writes it to
+// the torrent's Storage. Trackers, and the
+// DHT if one is set, are re-announced to in the background for as long as
+// the download runs, and peers connecting to port are served the pieces
+// downloaded so far.
+func (tf *TorrentFile) Download(clientID [20]byte, port uint16) error {
+	return tf.DownloadContext(context.Background(), clientID, port)
+}
+
+// DownloadContext is like Download but stops when ctx is cancelled. If the
+// torrent has a ResumeDir, progress is saved there while downloading and on
+// return, and a later download continues from it.
+func (tf *TorrentFile) DownloadContext(ctx context.Context, clientID [20]byte, port uint16) error {
+	st, have, rd, err := tf.openResumable(false)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	s := newSession(tf, clientID, port, st, have)
+	defer s.saveResume()
+	defer s.trackers.Close()
+
+	var known []Peer
+	if rd != nil {
+		known = s.restore(rd)
+	}
+
+	if unlisten, err := s.listen(); err != nil {
+		log.Printf("not accepting incoming peers: %v", err)
+	} else {
+		defer unlisten()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	peers, onComplete, err := s.announce(ctx, &wg)
+	if err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.choker.run(ctx)
+	}()
+
+	if tf.ResumeDir != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runResume(ctx)
+		}()
+	}
+
+	if len(peers) == 0 && len(known) == 0 && len(tf.WebSeeds) == 0 && len(tf.HTTPSeeds) == 0 && (tf.DHT == nil || tf.Private) && s.left.Load() > 0 {
+		return fmt.Errorf("tracker returned no peers")
+	}
+
+	s.addPeers(peers)
+	s.addPeers(known)
+	s.addWebSeeds(tf.WebSeeds)
+	s.addHTTPSeeds(tf.HTTPSeeds)
+
+	return s.run(ctx, onComplete)
+}
+
+// Seed serves the torrent's data from its Storage to peers until ctx is
+// cancelled. Every piece is verified first; seeding incomplete data is an
+// error.
+func (tf *TorrentFile) Seed(ctx context.Context, clientID [20]byte, port uint16) error {
+	st, have, _, err := tf.openResumable(true)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	s := newSession(tf, clientID, port, st, have)
+	defer s.close()
+	defer s.trackers.Close()
+
+	if left := s.left.Load(); left > 0 {
+		return fmt.Errorf("data is incomplete: %d of %d bytes missing or corrupt", left, tf.Length)
+	}
+
+	unlisten, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer unlisten()
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if _, _, err := s.announce(ctx, &wg); err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.choker.run(ctx)
+	}()
+
+	<-ctx.Done()
+	return nil
+}
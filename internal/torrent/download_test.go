@@ -0,0 +1,329 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"test/internal/dht"
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTorrent(t *testing.T, name string, data []byte, pieceLength int) *TorrentFile {
+	t.Helper()
+
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLength {
+		sum := sha1.Sum(data[i:min(i+pieceLength, len(data))])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	info, err := bencode.Marshal(map[string]any{
+		"name":         name,
+		"length":       len(data),
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	})
+	require.NoError(t, err)
+
+	tf, err := parseInfo(info, nil)
+	require.NoError(t, err)
+	return tf
+}
+
+// serveSeeder accepts connections on l and serves every piece of data.
+func serveSeeder(t *testing.T, l net.Listener, tf *TorrentFile, data []byte) {
+	t.Helper()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			hs := new(Handshake)
+			if err := hs.Read(conn); err != nil {
+				return
+			}
+			conn.Write(newHandshake(tf.InfoHash, [20]byte{'s'}).Bytes())
+
+			bf := newBitfield(len(tf.Pieces))
+			for i := range tf.Pieces {
+				bf.SetPiece(i)
+			}
+			conn.Write(NewBitfield(bf).Serialize())
+
+			for {
+				msg, err := ReadMessage(conn)
+				if err != nil {
+					return
+				}
+				if msg == nil {
+					continue
+				}
+
+				switch msg.ID {
+				case MsgInterested:
+					conn.Write(NewUnchoke().Serialize())
+				case MsgExtended:
+					id, payload, err := ParseExtended(msg)
+					if err != nil {
+						return
+					}
+					if id == extHandshakeID {
+						hs, _ := newExtHandshake(&ExtHandshake{
+							M:            map[string]int{utMetadata: 3},
+							MetadataSize: len(tf.infoBytes),
+						})
+						conn.Write(hs.Serialize())
+						continue
+					}
+					var mm metadataMessage
+					if _, err := bencode.UnmarshalPrefix(payload, &mm); err != nil || mm.MsgType != metadataRequest {
+						continue
+					}
+					begin := mm.Piece * metadataPieceSize
+					header, _ := bencode.Marshal(map[string]int{"msg_type": metadataData, "piece": mm.Piece, "total_size": len(tf.infoBytes)})
+					data := tf.infoBytes[begin:min(begin+metadataPieceSize, len(tf.infoBytes))]
+					conn.Write(NewExtended(utMetadataID, append(header, data...)).Serialize())
+				case MsgRequest:
+					req, err := ParseRequest(msg)
+					if err != nil {
+						return
+					}
+					off := req.Index*tf.PieceLength + req.Begin
+					conn.Write(NewPiece(req.Index, req.Begin, data[off:off+req.Length]).Serialize())
+				}
+			}
+		}()
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := make([]byte, 3*65536+1234)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	tf := newTestTorrent(t, "out.bin", data, 65536)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveSeeder(t, l, tf, data)
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{
+			"interval": 1800,
+			"peers":    []any{map[string]any{"ip": host, "port": portNum}},
+		})
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+	tf.Announce = tracker.URL + "/announce"
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	require.NoError(t, tf.Download([20]byte{'c'}, 6881))
+
+	got, err := os.ReadFile(filepath.Join(dir, "out.bin"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestDownload_DHT(t *testing.T) {
+	data := make([]byte, 2*65536+99)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	tf := newTestTorrent(t, "out.bin", data, 65536)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveSeeder(t, l, tf, data)
+
+	newNode := func(bootstrap ...string) *dht.Server {
+		d, err := dht.Listen(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: bootstrap, QueryTimeout: 500 * time.Millisecond})
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the seeder announces itself to a small swarm, the downloader only
+	// knows the router from the torrent's nodes
+	router := newNode()
+	seeder := newNode(router.Addr().String())
+	require.NoError(t, seeder.Bootstrap(ctx))
+	_, err = seeder.Announce(ctx, dht.ID(tf.InfoHash), uint16(l.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+
+	tf.Nodes = []string{router.Addr().String()}
+	tf.DHT = newNode()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	require.NoError(t, tf.Download([20]byte{'c'}, 6881))
+
+	got, err := os.ReadFile(filepath.Join(dir, "out.bin"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestSession_LimitsPeerConns(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+	s.maxConns = 2
+	defer s.close()
+
+	accepted := make(chan net.Conn, 10)
+	var peers []Peer
+	for range 4 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+		peers = append(peers, Peer{IP: "127.0.0.1", Port: uint16(l.Addr().(*net.TCPAddr).Port)})
+	}
+	s.addPeers(peers)
+
+	// the first two peers are dialed, the others wait for a free slot
+	first := <-accepted
+	<-accepted
+	select {
+	case <-accepted:
+		t.Fatal("more connections than allowed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.mu.Lock()
+	require.Len(t, s.pending, 2)
+	s.mu.Unlock()
+
+	first.Close()
+	<-accepted
+}
+
+func TestSession_RejectsInboundWhenFull(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+	s.maxConns = 0
+	defer s.close()
+
+	a, b := newConnPair(t)
+	s.addConn(a)
+
+	// the connection is closed rather than handed to a worker
+	b.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := b.read()
+	require.ErrorIs(t, err, io.EOF)
+	s.mu.Lock()
+	require.Zero(t, s.active)
+	s.mu.Unlock()
+}
+
+func TestSession_MarkHaveDoesNotBlock(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+	defer s.close()
+
+	// writes to a pipe block until the other end reads, which it never does
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	s.conns[&peerConn{conn: a}] = true
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.markHave(0)
+		s.markHave(1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("markHave blocked on the peer")
+	}
+	require.True(t, s.hasPiece(0))
+	require.True(t, s.hasPiece(1))
+}
+
+func TestSession_AnnounceRetriesFailedStart(t *testing.T) {
+	var requests atomic.Int32
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		buf, _ := bencode.Marshal(map[string]any{"interval": 1800, "peers": ""})
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+
+	// with a web seed, the download goes on without the tracker
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	tf.Announce = tracker.URL + "/announce"
+	tf.WebSeeds = []string{"http://seed.invalid/"}
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	_, onComplete, err := s.announce(ctx, &wg)
+	require.NoError(t, err)
+	require.NotNil(t, onComplete)
+
+	require.Eventually(t, func() bool { return requests.Load() >= 2 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	wg.Wait()
+}
+
+func TestSession_IgnoresStaleIdle(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+
+	// a peer that came and went leaves the idle signal behind, but another
+	// worker is running by the time run looks at it
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+	s.workerDone()
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.run(ctx, func() {}), context.DeadlineExceeded)
+}
@@ -0,0 +1,286 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"test/pkg/bencode"
+)
+
+// MsgExtended carries extension protocol messages (BEP 10). The first payload
+// byte is the extended message ID, 0 being the extended handshake.
+const MsgExtended MessageID = 20
+
+const extHandshakeID = 0
+
+// extensionBit is the reserved handshake bit advertising BEP 10 support
+// (the 20th bit from the right).
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+)
+
+const (
+	// clientVersion is sent as "v" in the extended handshake.
+	clientVersion = "bittorrent 0.1"
+	// maxPeerRequests is the number of outstanding requests we accept from a
+	// peer, sent as "reqq".
+	maxPeerRequests = 250
+)
+
+// SupportsExtensions reports whether the handshake advertises the extension
+// protocol.
+func (hs *Handshake) SupportsExtensions() bool {
+	return hs.Reserverd[extensionByte]&extensionBit != 0
+}
+
+// ExtHandshake is the payload of the extended handshake.
+type ExtHandshake struct {
+	// M maps extension names to the extended message IDs the sender wants
+	// to receive them with. An ID of 0 disables the extension.
+	M map[string]int `bencode:"m"`
+	// V is the client name and version.
+	V string `bencode:"v,omitempty"`
+	// P is the sender's listening port.
+	P int `bencode:"p,omitempty"`
+	// Reqq is the number of outstanding requests the sender accepts.
+	Reqq int `bencode:"reqq,omitempty"`
+	// MetadataSize is the size of the info dictionary, if the sender has it.
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+	// YourIP is the receiver's address as seen by the sender, in compact
+	// form (4 or 16 bytes).
+	YourIP string `bencode:"yourip,omitempty"`
+}
+
+// YourIPAddr returns YourIP as a net.IP, or nil if it is missing or invalid.
+func (hs *ExtHandshake) YourIPAddr() net.IP {
+	if len(hs.YourIP) != net.IPv4len && len(hs.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(hs.YourIP)
+}
+
+func NewExtended(id byte, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended returns the extended message ID and the payload following it.
+func ParseExtended(msg *Message) (byte, []byte, error) {
+	if err := msg.expect(MsgExtended); err != nil {
+		return 0, nil, err
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func newExtHandshake(hs *ExtHandshake) (*Message, error) {
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode extended handshake: %w", err)
+	}
+	return NewExtended(extHandshakeID, payload), nil
+}
+
+// ExtensionPeer is the view of a peer connection given to extensions.
+type ExtensionPeer interface {
+	// Addr returns the peer's "host:port" address.
+	Addr() string
+	// ExtHandshake returns the extended handshake received from the peer,
+	// or nil if it hasn't arrived yet.
+	ExtHandshake() *ExtHandshake
+	// SendExtended sends payload to the peer as a message of the named
+	// extension, using the ID the peer assigned to it.
+	SendExtended(name string, payload []byte) error
+}
+
+// Extension is a handler for a single named extension, e.g. "ut_pex".
+type Extension interface {
+	Name() string
+	// Handshake is called once the peer's extended handshake arrived, if the
+	// peer supports the extension.
+	Handshake(p ExtensionPeer, hs *ExtHandshake) error
+	// Handle is called for every message of the extension sent by the peer.
+	Handle(p ExtensionPeer, payload []byte) error
+	// Close is called when the connection to the peer is closed.
+	Close(p ExtensionPeer)
+}
+
+var ErrUnsupportedExtension = errors.New("peer does not support extension")
+
+// ExtensionRegistry holds the extensions offered to peers and assigns their
+// local extended message IDs in registration order.
+type ExtensionRegistry struct {
+	mu   sync.RWMutex
+	ids  map[string]byte
+	exts []Extension
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{ids: make(map[string]byte)}
+}
+
+func (r *ExtensionRegistry) Register(ext Extension) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := ext.Name()
+	if _, ok := r.ids[name]; ok {
+		return fmt.Errorf("extension already registered: %s", name)
+	}
+	if len(r.exts) == 255 {
+		return errors.New("too many extensions")
+	}
+
+	r.exts = append(r.exts, ext)
+	r.ids[name] = byte(len(r.exts))
+	return nil
+}
+
+// get returns the extension registered with the local ID.
+func (r *ExtensionRegistry) get(id byte) Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id == 0 || int(id) > len(r.exts) {
+		return nil
+	}
+	return r.exts[id-1]
+}
+
+func (r *ExtensionRegistry) all() []Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]Extension(nil), r.exts...)
+}
+
+// handshake builds our extended handshake for a peer at remote.
+func (r *ExtensionRegistry) handshake(port uint16, metadataSize int, remote net.Addr) *ExtHandshake {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hs := &ExtHandshake{
+		M:            make(map[string]int, len(r.ids)),
+		V:            clientVersion,
+		P:            int(port),
+		Reqq:         maxPeerRequests,
+		MetadataSize: metadataSize,
+	}
+	for name, id := range r.ids {
+		hs.M[name] = int(id)
+	}
+
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			hs.YourIP = string(ip4)
+		} else {
+			hs.YourIP = string(addr.IP.To16())
+		}
+	}
+
+	return hs
+}
+
+// extensionState is the extension protocol state of a single connection.
+type extensionState struct {
+	registry *ExtensionRegistry
+
+	mu     sync.Mutex
+	peerHs *ExtHandshake
+}
+
+func (pc *peerConn) Addr() string {
+	return pc.peer.addr()
+}
+
+func (pc *peerConn) ExtHandshake() *ExtHandshake {
+	if pc.ext == nil {
+		return nil
+	}
+	pc.ext.mu.Lock()
+	defer pc.ext.mu.Unlock()
+	return pc.ext.peerHs
+}
+
+func (pc *peerConn) SendExtended(name string, payload []byte) error {
+	hs := pc.ExtHandshake()
+	if hs == nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedExtension, name)
+	}
+	id, ok := hs.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedExtension, name)
+	}
+	return pc.send(NewExtended(byte(id), payload))
+}
+
+// startExtensions sends our extended handshake if the peer supports the
+// extension protocol.
+func (pc *peerConn) startExtensions(registry *ExtensionRegistry, port uint16, metadataSize int) error {
+	if registry == nil || !pc.handshake.SupportsExtensions() {
+		return nil
+	}
+
+	pc.ext = &extensionState{registry: registry}
+
+	msg, err := newExtHandshake(registry.handshake(port, metadataSize, pc.conn.RemoteAddr()))
+	if err != nil {
+		return err
+	}
+	return pc.send(msg)
+}
+
+// handleExtended dispatches an extended message to the registered extension.
+func (pc *peerConn) handleExtended(msg *Message) error {
+	id, payload, err := ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if pc.ext == nil {
+		return nil
+	}
+
+	if id == extHandshakeID {
+		var hs ExtHandshake
+		if err := bencode.Unmarshal(payload, &hs); err != nil {
+			return fmt.Errorf("invalid extended handshake: %w", err)
+		}
+
+		pc.ext.mu.Lock()
+		pc.ext.peerHs = &hs
+		pc.ext.mu.Unlock()
+
+		for _, ext := range pc.ext.registry.all() {
+			if id := hs.M[ext.Name()]; id <= 0 {
+				continue
+			}
+			if err := ext.Handshake(pc, &hs); err != nil {
+				return fmt.Errorf("%s: %w", ext.Name(), err)
+			}
+		}
+		return nil
+	}
+
+	ext := pc.ext.registry.get(id)
+	if ext == nil {
+		return nil
+	}
+	if err := ext.Handle(pc, payload); err != nil {
+		return fmt.Errorf("%s: %w", ext.Name(), err)
+	}
+	return nil
+}
+
+// closeExtensions notifies the extensions that the connection is gone.
+func (pc *peerConn) closeExtensions() {
+	if pc.ext == nil || pc.ExtHandshake() == nil {
+		return
+	}
+	for _, ext := range pc.ext.registry.all() {
+		ext.Close(pc)
+	}
+}
@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type echoExtension struct {
+	handshakes chan *ExtHandshake
+	received   chan string
+}
+
+func newEchoExtension() *echoExtension {
+	return &echoExtension{handshakes: make(chan *ExtHandshake, 1), received: make(chan string, 1)}
+}
+
+func (e *echoExtension) Name() string { return "x_echo" }
+
+func (e *echoExtension) Handshake(p ExtensionPeer, hs *ExtHandshake) error {
+	e.handshakes <- hs
+	return nil
+}
+
+func (e *echoExtension) Handle(p ExtensionPeer, payload []byte) error {
+	e.received <- string(payload)
+	return nil
+}
+
+func (e *echoExtension) Close(p ExtensionPeer) {}
+
+// newConnPair returns two connected peerConns that advertise the extension
+// protocol.
+func newConnPair(t *testing.T) (*peerConn, *peerConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	a, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	b := <-accepted
+	require.NotNil(t, b)
+
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	hs := newHandshake([20]byte{}, [20]byte{})
+	return &peerConn{conn: a, handshake: hs}, &peerConn{conn: b, handshake: hs}
+}
+
+func TestExtensions_HandshakeAndDispatch(t *testing.T) {
+	a, b := newConnPair(t)
+
+	regA := NewExtensionRegistry()
+	require.NoError(t, regA.Register(&metadataExtension{}))
+
+	echo := newEchoExtension()
+	regB := NewExtensionRegistry()
+	require.NoError(t, regB.Register(echo))
+	require.Error(t, regB.Register(newEchoExtension()))
+
+	require.NoError(t, a.startExtensions(regA, 6881, 1234))
+	require.NoError(t, b.startExtensions(regB, 6882, 0))
+
+	msg, err := b.read()
+	require.NoError(t, err)
+	require.NoError(t, b.handle(msg))
+
+	hs := b.ExtHandshake()
+	require.NotNil(t, hs)
+	require.Equal(t, map[string]int{utMetadata: 1}, hs.M)
+	require.Equal(t, clientVersion, hs.V)
+	require.Equal(t, 6881, hs.P)
+	require.Equal(t, maxPeerRequests, hs.Reqq)
+	require.Equal(t, 1234, hs.MetadataSize)
+	require.Equal(t, net.IPv4(127, 0, 0, 1).To4(), hs.YourIPAddr())
+
+	// b's echo extension wasn't offered by a, so its handshake isn't called
+	require.Empty(t, echo.handshakes)
+
+	msg, err = a.read()
+	require.NoError(t, err)
+	require.NoError(t, a.handle(msg))
+	require.Equal(t, map[string]int{"x_echo": 1}, a.ExtHandshake().M)
+
+	require.ErrorIs(t, b.SendExtended("x_unknown", nil), ErrUnsupportedExtension)
+	require.NoError(t, a.SendExtended("x_echo", []byte("hello")))
+
+	msg, err = b.read()
+	require.NoError(t, err)
+	require.NoError(t, b.handle(msg))
+	require.Equal(t, "hello", <-echo.received)
+}
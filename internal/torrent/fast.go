@@ -0,0 +1,201 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// Messages of the fast extension (BEP 6).
+const (
+	MsgSuggest     MessageID = 13
+	MsgHaveAll     MessageID = 14
+	MsgHaveNone    MessageID = 15
+	MsgReject      MessageID = 16
+	MsgAllowedFast MessageID = 17
+)
+
+// fastBit is the reserved handshake bit advertising the fast extension (the
+// third bit from the right).
+const (
+	fastByte = 7
+	fastBit  = 0x04
+)
+
+// allowedFastSetSize is the number of pieces a peer may request from us
+// while we choke it.
+const allowedFastSetSize = 10
+
+// errPieceRejected is returned by attemptDownloadPiece when the peer
+// rejects a request it could have served.
+var errPieceRejected = errors.New("peer rejected request")
+
+// SupportsFast reports whether the handshake advertises the fast extension.
+func (hs *Handshake) SupportsFast() bool {
+	return hs.Reserverd[fastByte]&fastBit != 0
+}
+
+func NewSuggest(index int) *Message {
+	return &Message{ID: MsgSuggest, Payload: NewHave(index).Payload}
+}
+
+func NewHaveAll() *Message { return &Message{ID: MsgHaveAll} }
+
+func NewHaveNone() *Message { return &Message{ID: MsgHaveNone} }
+
+func NewReject(index, begin, length int) *Message {
+	return &Message{ID: MsgReject, Payload: formatBlockRequest(index, begin, length)}
+}
+
+func NewAllowedFast(index int) *Message {
+	return &Message{ID: MsgAllowedFast, Payload: NewHave(index).Payload}
+}
+
+func ParseSuggest(msg *Message) (int, error) {
+	if err := msg.expect(MsgSuggest); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func ParseReject(msg *Message) (BlockRequest, error) {
+	if err := msg.expect(MsgReject); err != nil {
+		return BlockRequest{}, err
+	}
+	return parseBlockRequest(msg.Payload), nil
+}
+
+func ParseAllowedFast(msg *Message) (int, error) {
+	if err := msg.expect(MsgAllowedFast); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// allowedFastSet returns the k pieces a peer at ip may request while
+// choked, as generated by the canonical algorithm of BEP 6. It returns nil
+// for IPv6 peers.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	// peers in the same /24 get the same set
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// handleFast applies a message of the fast extension, which only peers
+// that advertised it may send.
+func (pc *peerConn) handleFast(msg *Message) error {
+	if !pc.fast {
+		return fmt.Errorf("%s from peer without the fast extension", msg.ID)
+	}
+
+	switch msg.ID {
+	case MsgHaveAll, MsgHaveNone:
+		if pc.picker != nil {
+			pc.picker.removeBitfield(pc.bitfield)
+		}
+		clear(pc.bitfield)
+		if msg.ID == MsgHaveAll {
+			for i := range pc.numPieces {
+				pc.bitfield.SetPiece(i)
+			}
+		}
+		if pc.picker != nil {
+			pc.picker.addBitfield(pc.bitfield)
+		}
+	case MsgSuggest:
+		index, err := ParseSuggest(msg)
+		if err != nil {
+			return err
+		}
+		pc.suggested.SetPiece(index)
+	case MsgAllowedFast:
+		index, err := ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		pc.allowedFast.SetPiece(index)
+	case MsgReject:
+		// rejects only concern the piece being downloaded, see pieceProgress
+		_, err := ParseReject(msg)
+		return err
+	}
+
+	return nil
+}
+
+// reject tells the peer that a request won't be served. Peers without the
+// fast extension aren't told.
+func (pc *peerConn) reject(req BlockRequest) error {
+	if !pc.fast {
+		return nil
+	}
+	return pc.send(NewReject(req.Index, req.Begin, req.Length))
+}
+
+// canRequest reports whether blocks of the piece may be requested from the
+// peer right now.
+func (pc *peerConn) canRequest(index int) bool {
+	return !pc.choked || pc.allowedFast.HasPiece(index)
+}
+
+// pickFrom picks the next piece to download from the peer. While the peer
+// chokes us, pieces it allows us to request anyway go first, then the
+// pieces it suggested.
+func (s *session) pickFrom(pc *peerConn) (int, bool) {
+	if !pc.fast {
+		return s.picker.pick(pc.bitfield)
+	}
+
+	has := pc.bitfield.andNot(pc.rejected)
+	if pc.choked {
+		if index, ok := s.picker.pick(has.and(pc.allowedFast)); ok {
+			return index, true
+		}
+	}
+	if index, ok := s.picker.pick(has.and(pc.suggested)); ok {
+		return index, true
+	}
+	return s.picker.pick(has)
+}
+
+// allowFast sends the peer its allowed fast set, limited to the pieces we
+// have, so it can start downloading before being unchoked.
+func (s *session) allowFast(pc *peerConn) error {
+	if !pc.fast {
+		return nil
+	}
+
+	for _, index := range allowedFastSet(net.ParseIP(pc.peer.IP), s.tf.InfoHash, s.tf.numPieces(), allowedFastSetSize) {
+		if !s.hasPiece(index) {
+			continue
+		}
+		pc.grantedFast.SetPiece(index)
+		if err := pc.send(NewAllowedFast(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveFastPeer accepts a single connection on l from a peer supporting the
+// fast extension, sends it have all and allowed fast for the pieces in
+// allowed, and passes every other message to handle.
+func serveFastPeer(t *testing.T, l net.Listener, tf *TorrentFile, allowed []int, handle func(conn net.Conn, msg *Message)) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	hs := new(Handshake)
+	if err := hs.Read(conn); err != nil {
+		return
+	}
+	if !hs.SupportsFast() {
+		t.Errorf("peer doesn't advertise the fast extension")
+		return
+	}
+	conn.Write(newHandshake(tf.InfoHash, [20]byte{'s'}).Bytes())
+	conn.Write(NewHaveAll().Serialize())
+	for _, index := range allowed {
+		conn.Write(NewAllowedFast(index).Serialize())
+	}
+
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg != nil {
+			handle(conn, msg)
+		}
+	}
+}
+
+// downloadFromFastPeer downloads tf from a single peer run by
+// serveFastPeer.
+func downloadFromFastPeer(t *testing.T, tf *TorrentFile, allowed []int, handle func(conn net.Conn, msg *Message)) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveFastPeer(t, l, tf, allowed, handle)
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{
+			"interval": 1800,
+			"peers":    []any{map[string]any{"ip": "127.0.0.1", "port": l.Addr().(*net.TCPAddr).Port}},
+		})
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+
+	tf.Announce = tracker.URL + "/announce"
+	tf.Storage = NewMemoryStorage()
+	require.NoError(t, tf.Download([20]byte{'l'}, 0))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+}
+
+// servePiece answers the request with the block of data.
+func servePiece(conn net.Conn, tf *TorrentFile, data []byte, req BlockRequest) {
+	off := req.Index*tf.PieceLength + req.Begin
+	conn.Write(NewPiece(req.Index, req.Begin, data[off:off+req.Length]).Serialize())
+}
+
+func TestAllowedFastSet(t *testing.T) {
+	ip := net.ParseIP("80.4.4.200")
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+
+	// the examples of BEP 6
+	require.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, allowedFastSet(ip, infoHash, 1313, 7))
+	require.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, allowedFastSet(ip, infoHash, 1313, 9))
+
+	// the last octet doesn't matter
+	require.Equal(t, allowedFastSet(ip, infoHash, 1313, 9), allowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 9))
+
+	require.ElementsMatch(t, []int{0, 1, 2}, allowedFastSet(ip, infoHash, 3, allowedFastSetSize))
+	require.Nil(t, allowedFastSet(net.ParseIP("::1"), infoHash, 1313, 7))
+}
+
+func TestFast_ServeRequest(t *testing.T) {
+	a, b := newConnPair(t)
+	a.fast = true
+	a.peer.Choked = true
+	a.grantedFast = newBitfield(4)
+	a.grantedFast.SetPiece(1)
+	a.serve = func(req BlockRequest) ([]byte, error) {
+		if req.Index == 3 {
+			return nil, errPieceUnavailable
+		}
+		return []byte("data"), nil
+	}
+
+	requests := []*Message{NewRequest(0, 0, 4), NewRequest(1, 0, 4), NewRequest(3, 0, 4)}
+	for _, msg := range requests {
+		require.NoError(t, a.handle(msg))
+	}
+
+	want := []*Message{NewReject(0, 0, 4), NewPiece(1, 0, []byte("data")), NewReject(3, 0, 4)}
+	for _, w := range want {
+		msg, err := b.read()
+		require.NoError(t, err)
+		require.Equal(t, w, msg)
+	}
+
+	// without the fast extension, unavailable pieces are an error
+	a.fast = false
+	a.peer.Choked = false
+	require.ErrorIs(t, a.handle(NewRequest(3, 0, 4)), errPieceUnavailable)
+	require.Error(t, a.handle(NewHaveAll()))
+}
+
+func TestSeed_AllowedFast(t *testing.T) {
+	data := randomBytes(t, 3*32768+17)
+	tf := newTestTorrent(t, "out.bin", data, 32768)
+	tf.Announce = newEmptyTracker(t).URL + "/announce"
+	tf.Storage = NewMemoryStorage()
+	st, err := tf.Storage.Open(tf)
+	require.NoError(t, err)
+	for i := range tf.numPieces() {
+		begin, end := tf.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+
+	ln, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	tf.Listener = ln
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- tf.Seed(ctx, [20]byte{'s'}, 0) }()
+	require.Eventually(t, func() bool { return ln.session(tf.InfoHash) != nil }, 5*time.Second, 10*time.Millisecond)
+
+	peer := Peer{IP: "127.0.0.1", Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+	pc, err := dialPeer(peer, tf.InfoHash, [20]byte{'c'}, tf.numPieces())
+	require.NoError(t, err)
+	defer pc.close()
+	pc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	require.True(t, pc.fast)
+
+	msg, err := pc.read()
+	require.NoError(t, err)
+	require.Equal(t, MsgHaveAll, msg.ID)
+	require.NoError(t, pc.handle(msg))
+
+	// with only four pieces, every one of them is allowed fast
+	for i := range tf.numPieces() {
+		for !pc.allowedFast.HasPiece(i) {
+			msg, err := pc.read()
+			require.NoError(t, err)
+			require.NoError(t, pc.handle(msg))
+		}
+	}
+
+	// the piece is served without being interested or unchoked
+	buf, err := attemptDownloadPiece(pc, &pieceWork{index: 2, length: tf.pieceSize(2)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, data[2*32768:3*32768], buf)
+	require.True(t, pc.choked)
+
+	cancel()
+	require.NoError(t, <-errc)
+}
+
+func TestDownload_AllowedFastWhileChoked(t *testing.T) {
+	data := randomBytes(t, 3*16384+100)
+	tf := newTestTorrent(t, "out.bin", data, 16384)
+
+	// the peer never unchokes us
+	downloadFromFastPeer(t, tf, []int{0, 1, 2, 3}, func(conn net.Conn, msg *Message) {
+		if msg.ID != MsgRequest {
+			return
+		}
+		req, _ := ParseRequest(msg)
+		servePiece(conn, tf, data, req)
+	})
+}
+
+func TestDownload_RejectedOnChoke(t *testing.T) {
+	data := randomBytes(t, 2*65536)
+	tf := newTestTorrent(t, "out.bin", data, 65536)
+
+	// the peer chokes us once, rejecting the request it got, rather than
+	// letting it time out
+	choked := false
+	downloadFromFastPeer(t, tf, nil, func(conn net.Conn, msg *Message) {
+		switch msg.ID {
+		case MsgInterested:
+			conn.Write(NewUnchoke().Serialize())
+		case MsgRequest:
+			req, _ := ParseRequest(msg)
+			if !choked {
+				choked = true
+				conn.Write(NewChoke().Serialize())
+				conn.Write(NewReject(req.Index, req.Begin, req.Length).Serialize())
+				conn.Write(NewUnchoke().Serialize())
+				return
+			}
+			servePiece(conn, tf, data, req)
+		}
+	})
+}
@@ -1,198 +1,95 @@
 package torrent
 
 import (
-	"encoding/binary"
-	"fmt"
-	"log"
-	"net"
-	"net/http"
-	"net/url"
+	"context"
 	"os"
-	"strconv"
-	"sync"
+	"test/internal/dht"
 	"test/pkg/bencode"
-	"time"
 )
 
 type TorrentFile struct {
-	Announce    string
-	Length      int
-	Name        string
-	PieceLength int
-	Pieces      [][20]byte
-	InfoHash    [20]byte
+	Announce     string
+	AnnounceList [][]string
+	Length       int
+	Name         string
+	Files        []File
+	PieceLength  int
+	Pieces       [][20]byte
+	// InfoHash identifies the torrent to trackers and peers. For v2 torrents
+	// without v1 pieces it is the truncated InfoHashV2.
+	InfoHash [20]byte
+	// InfoHashV2 is the SHA-256 info-hash of v2 and hybrid torrents, zero
+	// for v1 torrents (BEP 52).
+	InfoHashV2 [32]byte
+	// Private torrents only get peers from their trackers (BEP 27).
+	Private bool
+	// Nodes are the "host:port" addresses of DHT nodes given by the torrent.
+	Nodes []string
+	// WebSeeds are HTTP mirrors of the torrent data, given by its url-list
+	// (BEP 19).
+	WebSeeds []string
+	// HTTPSeeds are servers handing out pieces, given by its httpseeds
+	// (BEP 17).
+	HTTPSeeds []string
+	// DHT, if set, is used to find peers for torrents that aren't private.
+	DHT *dht.Server
+	// Listener, if set, accepts incoming connections for the torrent.
+	// Otherwise Download and Seed listen on their port themselves.
+	Listener *Listener
+	// Storage holds the torrent data. Files under the current directory are
+	// used if it is nil.
+	Storage Storage
+	// ResumeDir, if set, is where resume data is kept, so that a download
+	// continues where it stopped without rehashing unchanged files.
+	ResumeDir string
+	mode      infoMode
+	// piecesV2 are the v2 piece hashes, nil for v1 torrents and for v2
+	// torrents whose piece layers are unknown.
+	piecesV2 []pieceV2
+	// infoBytes is the raw info dictionary, served to peers fetching metadata.
+	infoBytes []byte
 }
 
-type Downloader interface {
-	Download(clientID [20]byte, port uint16) error
-}
-
-func NewFile(filename string) (Downloader, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	var src bencodeTorrent
-	if err := bencode.NewDecoder(f).Decode(&src); err != nil {
-		return nil, err
-	}
-
-	return src.toTorrentFile()
-}
-
-func (tf *TorrentFile) Download(clientID [20]byte, port uint16) error {
-	peers, err := tf.discoverPeers(clientID, port)
-	if err != nil {
-		return err
+// trackerTiers returns the announce-list, falling back to the single announce
+// URL for torrents without one.
+func (tf *TorrentFile) trackerTiers() [][]string {
+	if len(tf.AnnounceList) > 0 {
+		return tf.AnnounceList
 	}
-
-	hs := &Handshake{
-		Pstr:      []byte("BitTorrent protocol"),
-		Reserverd: [8]byte{},
-		InfoHash:  tf.InfoHash,
-		PeerID:    clientID,
-	}
-
-	var wg sync.WaitGroup
-
-	for _, peer := range peers {
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
-
-			addr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-			fmt.Println("Dialing peer:", addr)
-
-			conn, err := net.DialTimeout("tcp", addr, time.Second*5)
-			if err != nil {
-				fmt.Println("Dialing peer failed:", err)
-				return
-			}
-
-			_, err = conn.Write(hs.Bytes())
-			if err != nil {
-				fmt.Println("failed to write handshake:", err)
-				return
-			}
-
-			peerHandshake := new(Handshake)
-			err = peerHandshake.Read(conn)
-			if err != nil {
-				fmt.Println("HANDSHAKE READING FAILED", err)
-				return
-			}
-
-			fmt.Println("--- HANSHAKE SUCCESSFUL ---")
-
-			if !compare(peerHandshake.InfoHash[:], hs.InfoHash[:]) {
-				log.Println("info hashes are not matching for peer:", addr)
-				return
-			}
-
-			// interest
-			msg := Message{ID: 2}
-			_, err = conn.Write(msg.Serialize())
-			if err != nil {
-				fmt.Println("failed to write the message:", err)
-				return
-			}
-
-			// should be unchoke
-			newMessage, err := ReadMessage(conn)
-			if err != nil {
-				fmt.Println("failed to read the message:", err)
-				return
-			}
-			// fmt.Println("INTEREST RESPONSE (should be unchoke):", newMessage.ID)
-
-			if newMessage.ID == '1' {
-			}
-		}()
+	if tf.Announce != "" {
+		return [][]string{{tf.Announce}}
 	}
-
-	wg.Wait()
-
 	return nil
 }
 
-func compare(b1, b2 []byte) bool {
-	if len(b1) != len(b2) {
-		return false
-	}
-	for i := 0; i < len(b1); i++ {
-		if b1[i] != b2[i] {
-			return false
-		}
-	}
-	return true
-}
-
-func (tf *TorrentFile) buildHttpTrackerURL(peerID [20]byte, port uint16) (*url.URL, error) {
-	parsed, err := url.Parse(tf.Announce)
-	if err != nil {
-		return nil, err
-	}
-	v := url.Values{
-		"info_hash":  []string{string(tf.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{strconv.Itoa(tf.Length)},
-		// "compact":    []string{"1"},
-	}
-	parsed.RawQuery = v.Encode()
-
-	return parsed, nil
+// IsMultiFile reports whether the torrent describes a directory of files
+// rather than a single file.
+func (tf *TorrentFile) IsMultiFile() bool {
+	return tf.mode == multifile
 }
 
-func toPeer(b [6]byte) Peer {
-	return Peer{
-		PeerID: nil,
-		IP:     fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3]),
-		Port:   binary.BigEndian.Uint16([]byte{b[4], b[5]}),
-	}
+type Downloader interface {
+	Download(clientID [20]byte, port uint16) error
+	// DownloadContext is like Download but stops when ctx is cancelled.
+	DownloadContext(ctx context.Context, clientID [20]byte, port uint16) error
 }
 
-func parsePeersBinary(peers []byte) ([]Peer, error) {
-	if len(peers)%6 != 0 {
-		return nil, fmt.Errorf("peers received in wrong format: not divisible by 6 - %d", len(peers))
-	}
-
-	numPeers := len(peers) / 6
-	parsed := make([]Peer, numPeers)
-
-	for i := range parsed {
-		v := [6]byte{}
-		copy(v[:], peers[i:i+6])
-		parsed[i] = toPeer(v)
-	}
-
-	return parsed, nil
+func NewFile(filename string) (Downloader, error) {
+	return Open(filename)
 }
 
-func (tf *TorrentFile) discoverPeers(peerID [20]byte, port uint16) ([]Peer, error) {
-	trackerURL, err := tf.buildHttpTrackerURL(peerID, port)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.Get(trackerURL.String())
+// Open reads and parses a .torrent file.
+func Open(filename string) (*TorrentFile, error) {
+	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	var response TrackerResponse
-	if err := bencode.NewDecoder(resp.Body).Decode(&response); err != nil {
+	var src bencodeTorrent
+	if err := bencode.NewDecoder(f).Decode(&src); err != nil {
 		return nil, err
 	}
 
-	fmt.Println("RESPONSE", response)
-
-	// return parsePeersBinary(response.Peers)
-	return response.Peers, nil
+	return src.toTorrentFile()
 }
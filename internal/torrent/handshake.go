@@ -1,11 +1,12 @@
 package torrent
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 )
 
+const protocolID = "BitTorrent protocol"
+
 type Handshake struct {
 	// Pstrlen   int      `bencode:"pstrlen"`
 	Pstr      []byte   `bencode:"pstrlen"`
@@ -14,6 +15,17 @@ type Handshake struct {
 	PeerID    [20]byte `bencode:"peer_id"`
 }
 
+func newHandshake(infoHash, peerID [20]byte) *Handshake {
+	hs := &Handshake{
+		Pstr:     []byte(protocolID),
+		InfoHash: infoHash,
+		PeerID:   peerID,
+	}
+	hs.Reserverd[extensionByte] |= extensionBit
+	hs.Reserverd[fastByte] |= fastBit
+	return hs
+}
+
 func (hs *Handshake) Bytes() []byte {
 	buf := make([]byte, 49+len(hs.Pstr))
 	buf[0] = byte(len(hs.Pstr))
@@ -25,55 +37,30 @@ func (hs *Handshake) Bytes() []byte {
 	return buf
 }
 
+// Read reads a handshake from reader. It reads exactly the handshake bytes so
+// that messages following it are left in the reader.
 func (hs *Handshake) Read(reader io.Reader) error {
-	// hs := new(Handshake)
-	r := bufio.NewReader(reader)
-
-	length, err := r.ReadByte()
-	if err != nil {
+	var length [1]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
 		return err
 	}
 
-	l := int(length)
+	l := int(length[0])
 
-	if length <= 0 {
-		return fmt.Errorf("length cannot be less then zero: %d", l)
+	if l == 0 {
+		return fmt.Errorf("length cannot be zero: %d", l)
 	}
 
-	hs.Pstr = make([]byte, l)
-
-	n, err := r.Read(hs.Pstr)
-	if err != nil {
+	buf := make([]byte, l+48)
+	if _, err := io.ReadFull(reader, buf); err != nil {
 		return err
 	}
 
-	if n != l {
-		return fmt.Errorf("did not read expected amount: read %d, expected %d", n, l)
-	}
-
-	n, err = r.Read(hs.Reserverd[:])
-	if err != nil {
-		return err
-	}
-	if n != 8 {
-		return fmt.Errorf("did not read expected amount: read %d, expected %d", n, 8)
-	}
-
-	n, err = r.Read(hs.InfoHash[:])
-	if err != nil {
-		return err
-	}
-	if n != 20 {
-		return fmt.Errorf("did not read expected amount: read %d, expected %d", n, 20)
-	}
-
-	n, err = r.Read(hs.PeerID[:])
-	if err != nil {
-		return err
-	}
-	if n != 20 {
-		return fmt.Errorf("did not read expected amount: read %d, expected %d", n, 20)
-	}
+	hs.Pstr = buf[:l]
+	curr := l
+	curr += copy(hs.Reserverd[:], buf[curr:])
+	curr += copy(hs.InfoHash[:], buf[curr:])
+	copy(hs.PeerID[:], buf[curr:])
 
 	return nil
 }
@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter bounds how long we wait for a busy HTTP seed.
+const maxRetryAfter = 10 * time.Minute
+
+// httpSeed fetches pieces from a seed speaking the HTTP seeding protocol
+// (BEP 17), which serves a piece for ?info_hash=&piece= and, optionally,
+// only the byte ranges within it given by ranges=.
+type httpSeed struct {
+	url    string
+	tf     *TorrentFile
+	client *http.Client
+}
+
+func (hs *httpSeed) String() string {
+	return hs.url
+}
+
+// pieceURL returns the request for the piece. Pieces containing padding
+// only ask for the ranges of file data.
+func (hs *httpSeed) pieceURL(index int) (string, error) {
+	u, err := url.Parse(hs.url)
+	if err != nil {
+		return "", err
+	}
+
+	begin, end := hs.tf.pieceBounds(index)
+	spans, err := hs.tf.spans(begin, end-begin)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("info_hash", string(hs.tf.InfoHash[:]))
+	q.Set("piece", strconv.Itoa(index))
+
+	var ranges []string
+	padded := false
+	off := 0
+	for _, span := range spans {
+		if span.file.Padding {
+			padded = true
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", off, off+span.n-1))
+		}
+		off += span.n
+	}
+	if padded {
+		q.Set("ranges", strings.Join(ranges, ","))
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (hs *httpSeed) readPiece(ctx context.Context, index int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+
+	u, err := hs.pieceURL(index)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := hs.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		// the body of a busy seed is the number of seconds to wait
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+		if secs, err := strconv.Atoi(strings.TrimSpace(string(body))); err == nil && secs >= 0 {
+			return nil, &retryAfterError{wait: min(time.Duration(secs)*time.Second, maxRetryAfter)}
+		}
+		return nil, &httpStatusError{url: hs.url, code: resp.StatusCode}
+	default:
+		return nil, &httpStatusError{url: hs.url, code: resp.StatusCode}
+	}
+
+	begin, end := hs.tf.pieceBounds(index)
+	spans, err := hs.tf.spans(begin, end-begin)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response is the file data of the piece, padding left out
+	buf := make([]byte, end-begin)
+	p := buf
+	for _, span := range spans {
+		if !span.file.Padding {
+			if _, err := io.ReadFull(resp.Body, p[:span.n]); err != nil {
+				return nil, err
+			}
+		}
+		p = p[span.n:]
+	}
+	return buf, nil
+}
+
+// addHTTPSeeds starts a worker for every HTTP seed URL.
+func (s *session) addHTTPSeeds(urls []string) {
+	for _, u := range urls {
+		s.addSource(&httpSeed{url: u, tf: s.tf})
+	}
+}
@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newHTTPSeedServer serves the pieces of data, laid out as in tf, by the
+// HTTP seeding protocol. The first busy requests are answered with a wait
+// of zero seconds.
+func newHTTPSeedServer(t *testing.T, tf *TorrentFile, data []byte, busy int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("info_hash") != string(tf.InfoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt32(&busy, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("0"))
+			return
+		}
+
+		index, err := strconv.Atoi(q.Get("piece"))
+		if err != nil || index < 0 || index >= tf.numPieces() {
+			http.Error(w, "bad piece", http.StatusBadRequest)
+			return
+		}
+		begin, end := tf.pieceBounds(index)
+		piece := data[begin:end]
+		if !q.Has("ranges") {
+			w.Write(piece)
+			return
+		}
+		for _, rng := range strings.Split(q.Get("ranges"), ",") {
+			a, b, _ := strings.Cut(rng, "-")
+			first, _ := strconv.Atoi(a)
+			last, _ := strconv.Atoi(b)
+			w.Write(piece[first : last+1])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPSeed_PieceURL(t *testing.T) {
+	raw, _ := newTestTorrentV2(t, "root", testFilesV2(t), 32768, true)
+	tf := parseTestTorrentV2(t, raw)
+	hs := &httpSeed{url: "http://seed/serve?key=1", tf: tf}
+
+	u, err := hs.pieceURL(0)
+	require.NoError(t, err)
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	q := parsed.Query()
+	require.Equal(t, "/serve", parsed.Path)
+	require.Equal(t, "1", q.Get("key"))
+	require.Equal(t, string(tf.InfoHash[:]), q.Get("info_hash"))
+	require.Equal(t, "0", q.Get("piece"))
+	require.False(t, q.Has("ranges"))
+
+	// the last piece of "a" ends with padding
+	u, err = hs.pieceURL(2)
+	require.NoError(t, err)
+	parsed, err = url.Parse(u)
+	require.NoError(t, err)
+	require.Equal(t, "0-4463", parsed.Query().Get("ranges"))
+}
+
+func TestHTTPSeed_RetryAfter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("30\n"))
+	}))
+	defer srv.Close()
+
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	_, err := (&httpSeed{url: srv.URL, tf: tf}).readPiece(context.Background(), 0)
+	var busy *retryAfterError
+	require.ErrorAs(t, err, &busy)
+	require.Equal(t, 30*time.Second, busy.wait)
+}
+
+func TestHTTPSeeds(t *testing.T) {
+	buf := []byte("d8:announce3:foo9:httpseedsl13:http://seed/ae4:infod6:lengthi4e4:name1:a12:piece lengthi4e6:pieces20:aaaaaaaaaaaaaaaaaaaaee")
+	var bto bencodeTorrent
+	require.NoError(t, bencode.Unmarshal(buf, &bto))
+	tf, err := bto.toTorrentFile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://seed/a"}, tf.HTTPSeeds)
+}
+
+func TestDownload_HTTPSeed(t *testing.T) {
+	data := randomBytes(t, 100000)
+	tf := newTestTorrent(t, "out.bin", data, 16384)
+	tf.HTTPSeeds = []string{newHTTPSeedServer(t, tf, data, 2).URL}
+	tf.Storage = NewMemoryStorage()
+	require.NoError(t, tf.Download([20]byte{'l'}, 0))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+}
+
+func TestDownload_HTTPSeedV2(t *testing.T) {
+	raw, data := newTestTorrentV2(t, "root", testFilesV2(t), 32768, true)
+	tf := parseTestTorrentV2(t, raw)
+	tf.HTTPSeeds = []string{newHTTPSeedServer(t, tf, data, 0).URL}
+	tf.Storage = NewMemoryStorage()
+	require.NoError(t, tf.Download([20]byte{'l'}, 0))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+}
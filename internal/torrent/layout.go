@@ -0,0 +1,74 @@
+package torrent
+
+import "fmt"
+
+// File is a single file within the torrent data. Offset is the absolute
+// position of the file's first byte when all files are concatenated.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+	// Padding files align the next file to a piece boundary (BEP 47). They
+	// are all zeros and never stored.
+	Padding bool
+}
+
+// pieceBounds returns the absolute byte range [begin, end) covered by the piece.
+func (tf *TorrentFile) pieceBounds(index int) (begin, end int) {
+	begin = index * tf.PieceLength
+	end = min(begin+tf.PieceLength, tf.Length)
+	return begin, end
+}
+
+func (tf *TorrentFile) pieceSize(index int) int {
+	begin, end := tf.pieceBounds(index)
+	return end - begin
+}
+
+// fileSpan is the part of a byte range that falls into a single file.
+type fileSpan struct {
+	file File
+	// off is the offset of the span within the file.
+	off int
+	n   int
+}
+
+// spans splits the absolute byte range [off, off+n) across the files it
+// covers. Zero-length files never get a span.
+func (tf *TorrentFile) spans(off, n int) ([]fileSpan, error) {
+	if off < 0 || n < 0 || off+n > tf.Length {
+		return nil, fmt.Errorf("range [%d, %d) out of torrent bounds %d", off, off+n, tf.Length)
+	}
+
+	var spans []fileSpan
+	for _, f := range tf.Files {
+		if n == 0 {
+			break
+		}
+
+		fileEnd := f.Offset + f.Length
+		if off >= fileEnd || off < f.Offset {
+			continue
+		}
+
+		size := min(n, fileEnd-off)
+		spans = append(spans, fileSpan{file: f, off: off - f.Offset, n: size})
+		off += size
+		n -= size
+	}
+
+	return spans, nil
+}
+
+// pieceOffset returns the absolute offset of the range [off, off+n) within
+// the piece, checking that it stays inside the piece.
+func (tf *TorrentFile) pieceOffset(index, off, n int) (int, error) {
+	if index < 0 || index >= tf.numPieces() {
+		return 0, fmt.Errorf("piece index out of range: %d", index)
+	}
+	if off < 0 || n < 0 || off+n > tf.pieceSize(index) {
+		return 0, fmt.Errorf("range [%d, %d) out of bounds of piece %d", off, off+n, index)
+	}
+	begin, _ := tf.pieceBounds(index)
+	return begin + off, nil
+}
@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToTorrentFile_MultiFile(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefghij"), 5)
+
+	var pieces []byte
+	for i := 0; i < len(data); i += 16 {
+		sum := sha1.Sum(data[i:min(i+16, len(data))])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	raw, err := bencode.Marshal(map[string]any{
+		"announce": "http://tracker.local/announce",
+		"info": map[string]any{
+			"name":         "root",
+			"piece length": 16,
+			"pieces":       string(pieces),
+			"files": []any{
+				map[string]any{"length": 7, "path": []string{"a.txt"}},
+				map[string]any{"length": 0, "path": []string{"empty"}},
+				map[string]any{"length": 43, "path": []string{"sub", "b.bin"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	var src bencodeTorrent
+	require.NoError(t, bencode.NewDecoder(bytes.NewReader(raw)).Decode(&src))
+
+	tf, err := src.toTorrentFile()
+	require.NoError(t, err)
+	require.True(t, tf.IsMultiFile())
+	require.Equal(t, 50, tf.Length)
+	require.Equal(t, []File{
+		{Path: []string{"root", "a.txt"}, Length: 7, Offset: 0},
+		{Path: []string{"root", "empty"}, Length: 0, Offset: 7},
+		{Path: []string{"root", "sub", "b.bin"}, Length: 43, Offset: 7},
+	}, tf.Files)
+
+	dir := t.TempDir()
+	st, err := FileStorage{Dir: dir}.Open(tf)
+	require.NoError(t, err)
+	for i := range tf.Pieces {
+		begin, end := tf.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+	require.NoError(t, st.Close())
+
+	a, err := os.ReadFile(filepath.Join(dir, "root", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, data[:7], a)
+
+	b, err := os.ReadFile(filepath.Join(dir, "root", "sub", "b.bin"))
+	require.NoError(t, err)
+	require.Equal(t, data[7:], b)
+}
+
+func TestToTorrentFile_RejectsTraversal(t *testing.T) {
+	info, err := bencode.Marshal(bencodeInfo{
+		Name:        "root",
+		PieceLength: 16,
+		Pieces:      string(make([]byte, 20)),
+		Files:       []file{{Length: 1, Path: []string{"..", "etc"}}},
+	})
+	require.NoError(t, err)
+
+	src := bencodeTorrent{Info: info}
+	_, err = src.toTorrentFile()
+	require.Error(t, err)
+}
+
+func TestToTorrentFile_RejectsTraversalName(t *testing.T) {
+	for _, info := range []bencodeInfo{
+		{Name: "../escape", Length: 1},
+		{Name: "..", Files: []file{{Length: 1, Path: []string{"etc"}}}},
+		{Name: "", Length: 1},
+		{Name: `a\b`, Length: 1},
+	} {
+		info.PieceLength = 16
+		info.Pieces = string(make([]byte, 20))
+		raw, err := bencode.Marshal(info)
+		require.NoError(t, err)
+
+		src := bencodeTorrent{Info: raw}
+		_, err = src.toTorrentFile()
+		require.Error(t, err, info.Name)
+	}
+}
@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxHandshakes is the number of incoming connections a Listener handshakes
+// with at once. Connections beyond it are closed right away.
+const maxHandshakes = 32
+
+// Listener accepts incoming peer connections and hands each to the session
+// of the torrent whose info-hash the peer asks for.
+type Listener struct {
+	l net.Listener
+	// handshakes holds a token for every connection being handshaked.
+	handshakes chan struct{}
+
+	mu       sync.Mutex
+	sessions map[[20]byte]*session
+
+	wg sync.WaitGroup
+}
+
+// Listen starts accepting peer connections on the TCP address addr, e.g.
+// ":6881".
+func Listen(addr string) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &Listener{
+		l:          l,
+		handshakes: make(chan struct{}, maxHandshakes),
+		sessions:   make(map[[20]byte]*session),
+	}
+
+	ln.wg.Add(1)
+	go ln.serve()
+
+	return ln, nil
+}
+
+func (ln *Listener) Addr() net.Addr {
+	return ln.l.Addr()
+}
+
+// Close stops accepting connections. Established connections are left to
+// their sessions.
+func (ln *Listener) Close() error {
+	err := ln.l.Close()
+	ln.wg.Wait()
+	return err
+}
+
+func (ln *Listener) add(s *session) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.sessions[s.tf.InfoHash] = s
+}
+
+func (ln *Listener) remove(s *session) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.sessions[s.tf.InfoHash] == s {
+		delete(ln.sessions, s.tf.InfoHash)
+	}
+}
+
+func (ln *Listener) session(infoHash [20]byte) *session {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	return ln.sessions[infoHash]
+}
+
+func (ln *Listener) serve() {
+	defer ln.wg.Done()
+
+	for {
+		conn, err := ln.l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("accept failed: %v", err)
+			continue
+		}
+
+		select {
+		case ln.handshakes <- struct{}{}:
+			go func() {
+				defer func() { <-ln.handshakes }()
+				ln.accept(conn)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// accept performs the responder side of the handshake: the peer's handshake
+// names the torrent, and we only answer if it is one of ours.
+func (ln *Listener) accept(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hs := new(Handshake)
+	if err := hs.Read(conn); err != nil {
+		conn.Close()
+		return
+	}
+
+	s := ln.session(hs.InfoHash)
+	if s == nil {
+		conn.Close()
+		return
+	}
+
+	if _, err := conn.Write(newHandshake(s.tf.InfoHash, s.clientID).Bytes()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+
+	peer := Peer{IP: host, Port: uint16(portNum)}
+	s.addConn(newPeerConn(conn, peer, hs, s.tf.numPieces()))
+}
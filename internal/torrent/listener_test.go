@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newEmptyTracker(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{"interval": 1800, "peers": ""})
+		w.Write(buf)
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+func TestSeed(t *testing.T) {
+	data := make([]byte, 3*32768+17)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("out.bin", data, 0o644))
+
+	tf := newTestTorrent(t, "out.bin", data, 32768)
+	tf.Announce = newEmptyTracker(t).URL + "/announce"
+
+	ln, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	tf.Listener = ln
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- tf.Seed(ctx, [20]byte{'s'}, 0) }()
+
+	require.Eventually(t, func() bool { return ln.session(tf.InfoHash) != nil }, 5*time.Second, 10*time.Millisecond)
+
+	addr := ln.Addr().(*net.TCPAddr)
+	peer := Peer{IP: "127.0.0.1", Port: uint16(addr.Port)}
+
+	// peers asking for other torrents are turned away
+	_, err = dialPeer(peer, [20]byte{'x'}, [20]byte{'c'}, len(tf.Pieces))
+	require.Error(t, err)
+
+	pc, err := dialPeer(peer, tf.InfoHash, [20]byte{'c'}, len(tf.Pieces))
+	require.NoError(t, err)
+	defer pc.close()
+	pc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, pc.send(NewInterested()))
+	for pc.choked {
+		msg, err := pc.read()
+		require.NoError(t, err)
+		require.NoError(t, pc.handle(msg))
+	}
+	for i := range tf.Pieces {
+		require.True(t, pc.bitfield.HasPiece(i))
+	}
+
+	require.NoError(t, pc.send(NewRequest(3, 0, 17)))
+	for {
+		msg, err := pc.read()
+		require.NoError(t, err)
+		if msg == nil || msg.ID != MsgPiece {
+			continue
+		}
+		index, begin, block, err := ParsePiece(msg)
+		require.NoError(t, err)
+		require.Equal(t, 3, index)
+		require.Equal(t, 0, begin)
+		require.Equal(t, data[3*32768:], block)
+		break
+	}
+
+	// requests past the end of a piece get the peer disconnected
+	require.NoError(t, pc.send(NewRequest(3, 0, 18)))
+	for {
+		if _, err := pc.read(); err != nil {
+			break
+		}
+	}
+
+	cancel()
+	require.NoError(t, <-errc)
+}
+
+func TestSeed_IncompleteData(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	tf.Announce = newEmptyTracker(t).URL + "/announce"
+
+	err := tf.Seed(context.Background(), [20]byte{'s'}, 0)
+	require.ErrorContains(t, err, "incomplete")
+}
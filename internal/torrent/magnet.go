@@ -0,0 +1,228 @@
+package torrent
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"test/internal/dht"
+	"time"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	// btmhPrefix is followed by the multihash of a v2 info-hash: 0x12 for
+	// SHA-256, 0x20 for its length, then the hash (BEP 52).
+	btmhPrefix = "urn:btmh:1220"
+)
+
+// ErrV2OnlyMagnet is returned by ParseMagnet for links to v2-only torrents,
+// i.e. with urn:btmh: but no urn:btih: exact topic. Their piece layers
+// aren't part of the info dictionary and fetching them isn't supported, so
+// they couldn't be downloaded.
+var ErrV2OnlyMagnet = errors.New("magnet links to v2-only torrents are not supported")
+
+// Magnet is a parsed magnet link. It carries the info-hash, but the info
+// dictionary has to be fetched from peers (BEP 9).
+type Magnet struct {
+	// InfoHash is the v1 info-hash.
+	InfoHash [20]byte
+	// InfoHashV2 is the v2 info-hash of links to hybrid torrents.
+	InfoHashV2 [32]byte
+	// Name is the display name, used until the metadata is known.
+	Name     string
+	Trackers []string
+	// Peers are the "host:port" addresses of peers given by x.pe.
+	Peers    []string
+	WebSeeds []string
+	// DHT, if set, is used to find peers in addition to the trackers.
+	DHT *dht.Server
+	// ResumeDir is passed on to the fetched TorrentFile.
+	ResumeDir string
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		Peers:    q["x.pe"],
+		WebSeeds: q["ws"],
+	}
+
+	foundV1, foundV2 := false, false
+	for _, xt := range q["xt"] {
+		switch {
+		case strings.HasPrefix(xt, btihPrefix) && !foundV1:
+			hash, err := parseInfoHash(strings.TrimPrefix(xt, btihPrefix))
+			if err != nil {
+				return nil, err
+			}
+			m.InfoHash = hash
+			foundV1 = true
+		case strings.HasPrefix(xt, btmhPrefix) && !foundV2:
+			b, err := hex.DecodeString(strings.TrimPrefix(xt, btmhPrefix))
+			if err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("invalid v2 info hash: %q", xt)
+			}
+			m.InfoHashV2 = [32]byte(b)
+			foundV2 = true
+		}
+	}
+
+	switch {
+	case foundV1:
+	case foundV2:
+		return nil, ErrV2OnlyMagnet
+	default:
+		return nil, errors.New("magnet link has no urn:btih: or urn:btmh: exact topic")
+	}
+
+	return m, nil
+}
+
+// parseInfoHash parses a v1 info-hash in either hex or base32 encoding.
+func parseInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return hash, fmt.Errorf("info hash has invalid length: %d", len(s))
+	}
+	if err != nil {
+		return hash, fmt.Errorf("invalid info hash: %w", err)
+	}
+
+	copy(hash[:], b)
+	return hash, nil
+}
+
+func (m *Magnet) peers() []Peer {
+	peers := make([]Peer, 0, len(m.Peers))
+	for _, addr := range m.Peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: host, Port: uint16(n)})
+	}
+	return peers
+}
+
+func (m *Magnet) trackerTiers() [][]string {
+	tiers := make([][]string, len(m.Trackers))
+	for i, tr := range m.Trackers {
+		tiers[i] = []string{tr}
+	}
+	return tiers
+}
+
+// FetchTorrent downloads the info dictionary from the swarm and returns the
+// complete TorrentFile.
+func (m *Magnet) FetchTorrent(ctx context.Context, clientID [20]byte, port uint16) (*TorrentFile, error) {
+	peers := m.peers()
+
+	if len(m.Trackers) > 0 {
+		tl := NewTrackerList(m.trackerTiers())
+		resp, err := tl.Announce(ctx, &AnnounceRequest{
+			InfoHash: m.InfoHash,
+			PeerID:   clientID,
+			Port:     port,
+			// the size is unknown until we have the metadata, but trackers
+			// may not hand out seeders to clients reporting nothing left
+			Left:  metadataPieceSize,
+			Event: EventStarted,
+		})
+		tl.Close()
+		if err != nil && len(peers) == 0 && m.DHT == nil {
+			return nil, err
+		}
+		if err == nil {
+			peers = append(peers, resp.AllPeers()...)
+		}
+	}
+
+	if m.DHT != nil {
+		if err := m.DHT.Bootstrap(ctx); err != nil {
+			log.Printf("dht bootstrap failed: %v", err)
+		}
+		found, err := m.DHT.GetPeers(ctx, dht.ID(m.InfoHash))
+		if err != nil {
+			log.Printf("dht lookup failed: %v", err)
+		}
+		peers = append(peers, dhtPeers(found)...)
+	}
+
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch metadata from")
+	}
+
+	raw, err := fetchMetadata(ctx, peers, m.InfoHash, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	tf, err := parseInfo(raw, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tf.DHT = m.DHT
+	tf.ResumeDir = m.ResumeDir
+	tf.WebSeeds = m.WebSeeds
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+		tf.AnnounceList = m.trackerTiers()
+	}
+
+	return tf, nil
+}
+
+// Download fetches the metadata and then downloads the torrent.
+func (m *Magnet) Download(clientID [20]byte, port uint16) error {
+	return m.DownloadContext(context.Background(), clientID, port)
+}
+
+// DownloadContext is like Download but stops when ctx is cancelled.
+func (m *Magnet) DownloadContext(ctx context.Context, clientID [20]byte, port uint16) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	tf, err := m.FetchTorrent(fetchCtx, clientID, port)
+	if err != nil {
+		return err
+	}
+
+	return tf.DownloadContext(ctx, clientID, port)
+}
+
+// NewMagnet parses a magnet link. The returned Downloader fetches the
+// metadata from peers before downloading.
+func NewMagnet(uri string) (Downloader, error) {
+	return ParseMagnet(uri)
+}
@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMagnet(t *testing.T) {
+	want := [20]byte{0xc9, 0xe1, 0x57, 0x63, 0xf7, 0x22, 0xf2, 0x3e, 0x98, 0xa2, 0x9d, 0xec, 0xdf, 0xae, 0x34, 0x1b, 0x98, 0xd5, 0x30, 0x56}
+
+	m, err := ParseMagnet("magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&dn=Cosmos+Laundromat" +
+		"&tr=udp%3A%2F%2Fexplodie.org%3A6969&tr=wss%3A%2F%2Ftracker.btorrent.xyz" +
+		"&x.pe=10.0.0.1:6881&ws=https%3A%2F%2Fwebtorrent.io%2Ftorrents%2F")
+	require.NoError(t, err)
+	require.Equal(t, &Magnet{
+		InfoHash: want,
+		Name:     "Cosmos Laundromat",
+		Trackers: []string{"udp://explodie.org:6969", "wss://tracker.btorrent.xyz"},
+		Peers:    []string{"10.0.0.1:6881"},
+		WebSeeds: []string{"https://webtorrent.io/torrents/"},
+	}, m)
+	require.Equal(t, []Peer{{IP: "10.0.0.1", Port: 6881}}, m.peers())
+
+	m, err = ParseMagnet("magnet:?xt=urn:btih:ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW")
+	require.NoError(t, err)
+	require.Equal(t, want, m.InfoHash)
+
+	v2 := "2b8b3b3f1fb05e8d2f2a2e2f2b6a1d1a8e6e5c4b3a29181716151413121110ff"
+	_, err = ParseMagnet("magnet:?xt=urn:btmh:1220" + v2)
+	require.ErrorIs(t, err, ErrV2OnlyMagnet)
+
+	// hybrid links keep the v1 info-hash for the wire
+	m, err = ParseMagnet("magnet:?xt=urn:btmh:1220" + v2 + "&xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056")
+	require.NoError(t, err)
+	require.Equal(t, want, m.InfoHash)
+	require.Equal(t, v2, hex.EncodeToString(m.InfoHashV2[:]))
+
+	for _, uri := range []string{
+		"http://example.com",
+		"magnet:?xt=urn:btmh:1220c9e157",
+		"magnet:?dn=no+hash",
+		"magnet:?xt=urn:btih:c9e157",
+		"magnet:?xt=urn:btih:z9e15763f722f23e98a29decdfae341b98d53056",
+	} {
+		_, err := ParseMagnet(uri)
+		require.Error(t, err, uri)
+	}
+}
+
+func TestMagnet_FetchTorrent(t *testing.T) {
+	data := make([]byte, 40*65536)
+	_, err := io.ReadFull(rand.Reader, data)
+	require.NoError(t, err)
+
+	// large enough for the metadata to span several pieces
+	tf := newTestTorrent(t, "out.bin", data, 1024)
+	require.Greater(t, len(tf.infoBytes), 2*metadataPieceSize)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveSeeder(t, l, tf, data)
+
+	m := &Magnet{InfoHash: tf.InfoHash, Peers: []string{l.Addr().String()}}
+
+	got, err := m.FetchTorrent(context.Background(), [20]byte{'c'}, 6881)
+	require.NoError(t, err)
+	require.Equal(t, tf.InfoHash, got.InfoHash)
+	require.Equal(t, tf.Pieces, got.Pieces)
+	require.Equal(t, tf.Length, got.Length)
+
+	m.InfoHash[0] ^= 0xff
+	_, err = m.FetchTorrent(context.Background(), [20]byte{'c'}, 6881)
+	require.Error(t, err)
+}
@@ -1,25 +1,153 @@
 package torrent
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+type MessageID byte
+
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+)
+
+// MaxMessageLength is the largest length prefix ReadMessage accepts. It
+// leaves room for the bitfield of very large torrents and for blocks larger
+// than the 16 KiB that clients request in practice.
+const MaxMessageLength = 1 << 20
+
+var ErrMessageTooLarge = errors.New("message exceeds maximum length")
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggest:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(id))
+}
+
+// Message is a single peer wire protocol message. Keep-alive messages have
+// neither an ID nor a payload and are represented by a nil *Message.
 type Message struct {
-	ID      byte
+	ID      MessageID
 	Payload []byte
 }
 
+// BlockRequest identifies a block within a piece, as carried by request and
+// cancel messages.
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Serialize encodes the message as <length prefix><id><payload>. A nil
+// message is a keep-alive.
 func (msg *Message) Serialize() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, 1+len(msg.Payload))
-	buf.WriteByte(msg.ID)
-	buf.Write(msg.Payload)
-	return buf.Bytes()
+	if msg == nil {
+		return make([]byte, 4)
+	}
+	buf := make([]byte, 5+len(msg.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(msg.Payload)))
+	buf[4] = byte(msg.ID)
+	copy(buf[5:], msg.Payload)
+	return buf
+}
+
+func (msg *Message) String() string {
+	if msg == nil {
+		return "keep-alive"
+	}
+	return fmt.Sprintf("%s [%d]", msg.ID, len(msg.Payload))
 }
 
+// validate checks the payload length of the messages known to this package.
+// Messages with other IDs are passed through unchecked.
+func (msg *Message) validate() error {
+	if msg == nil {
+		return nil
+	}
+
+	want := -1
+	switch msg.ID {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		want = 0
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		want = 4
+	case MsgRequest, MsgCancel, MsgReject:
+		want = 12
+	case MsgPort:
+		want = 2
+	case MsgExtended:
+		if len(msg.Payload) < 1 {
+			return fmt.Errorf("%s payload too short: %d", msg.ID, len(msg.Payload))
+		}
+	case MsgPiece:
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("%s payload too short: %d", msg.ID, len(msg.Payload))
+		}
+	}
+
+	if want >= 0 && len(msg.Payload) != want {
+		return fmt.Errorf("%s payload has wrong length: got %d, expected %d", msg.ID, len(msg.Payload), want)
+	}
+
+	return nil
+}
+
+func (msg *Message) expect(id MessageID) error {
+	if msg == nil {
+		return fmt.Errorf("expected %s, got keep-alive", id)
+	}
+	if msg.ID != id {
+		return fmt.Errorf("expected %s, got %s", id, msg.ID)
+	}
+	return msg.validate()
+}
+
+// ReadMessage reads a single message from r. Keep-alive messages are
+// returned as nil.
 func ReadMessage(r io.Reader) (*Message, error) {
 	var length uint32
 
@@ -32,21 +160,123 @@ func ReadMessage(r io.Reader) (*Message, error) {
 		return nil, nil
 	}
 
-	var b [1]byte
-	if _, err = io.ReadFull(r, b[:]); err != nil {
+	if length > MaxMessageLength {
+		return nil, fmt.Errorf("%w: %d", ErrMessageTooLarge, length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
-	msg := new(Message)
 
-	msg.ID = b[0]
-	msg.Payload = make([]byte, length-1)
+	msg := &Message{ID: MessageID(buf[0]), Payload: buf[1:]}
+	if err := msg.validate(); err != nil {
+		return nil, err
+	}
 
-	_, err = io.ReadFull(r, msg.Payload)
-	if err != nil {
+	return msg, nil
+}
+
+func NewKeepAlive() *Message { return nil }
+
+func NewChoke() *Message { return &Message{ID: MsgChoke} }
+
+func NewUnchoke() *Message { return &Message{ID: MsgUnchoke} }
+
+func NewInterested() *Message { return &Message{ID: MsgInterested} }
+
+func NewNotInterested() *Message { return &Message{ID: MsgNotInterested} }
+
+func NewHave(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: MsgHave, Payload: payload}
+}
+
+func NewBitfield(bf []byte) *Message {
+	return &Message{ID: MsgBitfield, Payload: bf}
+}
+
+func NewRequest(index, begin, length int) *Message {
+	return &Message{ID: MsgRequest, Payload: formatBlockRequest(index, begin, length)}
+}
+
+func NewPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func NewCancel(index, begin, length int) *Message {
+	return &Message{ID: MsgCancel, Payload: formatBlockRequest(index, begin, length)}
+}
+
+func NewPort(port uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+	return &Message{ID: MsgPort, Payload: payload}
+}
+
+func formatBlockRequest(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return payload
+}
+
+func parseBlockRequest(payload []byte) BlockRequest {
+	return BlockRequest{
+		Index:  int(binary.BigEndian.Uint32(payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}
+}
+
+func ParseHave(msg *Message) (int, error) {
+	if err := msg.expect(MsgHave); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func ParseBitfield(msg *Message) ([]byte, error) {
+	if err := msg.expect(MsgBitfield); err != nil {
 		return nil, err
 	}
+	return msg.Payload, nil
+}
 
-	fmt.Println("Message:", msg.ID, msg.Payload)
+func ParseRequest(msg *Message) (BlockRequest, error) {
+	if err := msg.expect(MsgRequest); err != nil {
+		return BlockRequest{}, err
+	}
+	return parseBlockRequest(msg.Payload), nil
+}
 
-	return msg, nil
+func ParseCancel(msg *Message) (BlockRequest, error) {
+	if err := msg.expect(MsgCancel); err != nil {
+		return BlockRequest{}, err
+	}
+	return parseBlockRequest(msg.Payload), nil
+}
+
+// ParsePiece returns the piece index, the block offset and the block data of
+// a piece message. The block aliases the message payload.
+func ParsePiece(msg *Message) (index, begin int, block []byte, err error) {
+	if err := msg.expect(MsgPiece); err != nil {
+		return 0, 0, nil, err
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+func ParsePort(msg *Message) (uint16, error) {
+	if err := msg.expect(MsgPort); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(msg.Payload), nil
 }
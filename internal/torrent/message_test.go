@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_RoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  *Message
+	}{
+		{"keep-alive", NewKeepAlive()},
+		{"choke", NewChoke()},
+		{"unchoke", NewUnchoke()},
+		{"interested", NewInterested()},
+		{"not interested", NewNotInterested()},
+		{"have", NewHave(42)},
+		{"bitfield", NewBitfield([]byte{0xff, 0x80})},
+		{"request", NewRequest(1, 16384, 16384)},
+		{"piece", NewPiece(1, 0, []byte("block"))},
+		{"cancel", NewCancel(1, 16384, 16384)},
+		{"port", NewPort(6881)},
+		{"suggest piece", NewSuggest(5)},
+		{"have all", NewHaveAll()},
+		{"have none", NewHaveNone()},
+		{"reject request", NewReject(1, 0, 16384)},
+		{"allowed fast", NewAllowedFast(9)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ReadMessage(bytes.NewReader(tc.msg.Serialize()))
+			require.NoError(t, err)
+			require.Equal(t, tc.msg.Serialize(), got.Serialize())
+		})
+	}
+}
+
+func TestMessage_Parse(t *testing.T) {
+	index, err := ParseHave(NewHave(7))
+	require.NoError(t, err)
+	require.Equal(t, 7, index)
+
+	req, err := ParseRequest(NewRequest(3, 16384, 100))
+	require.NoError(t, err)
+	require.Equal(t, BlockRequest{Index: 3, Begin: 16384, Length: 100}, req)
+
+	cancel, err := ParseCancel(NewCancel(3, 0, 16384))
+	require.NoError(t, err)
+	require.Equal(t, BlockRequest{Index: 3, Begin: 0, Length: 16384}, cancel)
+
+	index, begin, block, err := ParsePiece(NewPiece(2, 32, []byte("abc")))
+	require.NoError(t, err)
+	require.Equal(t, 2, index)
+	require.Equal(t, 32, begin)
+	require.Equal(t, []byte("abc"), block)
+
+	port, err := ParsePort(NewPort(51413))
+	require.NoError(t, err)
+	require.Equal(t, uint16(51413), port)
+
+	index, err = ParseSuggest(NewSuggest(11))
+	require.NoError(t, err)
+	require.Equal(t, 11, index)
+
+	reject, err := ParseReject(NewReject(4, 16384, 100))
+	require.NoError(t, err)
+	require.Equal(t, BlockRequest{Index: 4, Begin: 16384, Length: 100}, reject)
+
+	index, err = ParseAllowedFast(NewAllowedFast(12))
+	require.NoError(t, err)
+	require.Equal(t, 12, index)
+
+	_, err = ParseHave(NewChoke())
+	require.Error(t, err)
+
+	_, err = ParseRequest(nil)
+	require.Error(t, err)
+}
+
+func TestReadMessage_Invalid(t *testing.T) {
+	_, err := ReadMessage(bytes.NewReader((&Message{ID: MsgHave, Payload: []byte{1, 2}}).Serialize()))
+	require.Error(t, err)
+
+	_, err = ReadMessage(bytes.NewReader((&Message{ID: MsgUnchoke, Payload: []byte{1}}).Serialize()))
+	require.Error(t, err)
+
+	_, err = ReadMessage(bytes.NewReader((&Message{ID: MsgPiece, Payload: []byte{1}}).Serialize()))
+	require.Error(t, err)
+
+	_, err = ReadMessage(bytes.NewReader((&Message{ID: MsgHaveAll, Payload: []byte{1}}).Serialize()))
+	require.Error(t, err)
+
+	huge := binary.BigEndian.AppendUint32(nil, MaxMessageLength+1)
+	_, err = ReadMessage(bytes.NewReader(huge))
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+}
@@ -0,0 +1,262 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"test/pkg/bencode"
+	"time"
+)
+
+const (
+	// metadataPieceSize is the size of every metadata piece but the last.
+	metadataPieceSize = 16384
+	// maxMetadataSize guards against peers announcing absurd metadata sizes.
+	maxMetadataSize = 16 << 20
+	// maxMetadataPeers is the number of peers asked for metadata at once.
+	maxMetadataPeers = 20
+
+	utMetadata = "ut_metadata"
+	// utMetadataID is the extended message ID peers use to send us ut_metadata
+	// messages.
+	utMetadataID = 1
+)
+
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// fetchMetadata asks peers for the info dictionary of infoHash via the
+// ut_metadata extension (BEP 9) and returns the first copy that verifies.
+func fetchMetadata(ctx context.Context, peers []Peer, infoHash, clientID [20]byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := make(chan []byte, 1)
+	sem := make(chan struct{}, maxMetadataPeers)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+
+			raw, err := fetchMetadataFrom(ctx, peer, infoHash, clientID)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", peer.addr(), err))
+				mu.Unlock()
+				return
+			}
+
+			select {
+			case result <- raw:
+				cancel()
+			default:
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	select {
+	case raw := <-result:
+		return raw, nil
+	default:
+	}
+
+	if err := ctx.Err(); err != nil && len(errs) == 0 {
+		return nil, err
+	}
+	return nil, fmt.Errorf("failed to fetch metadata: %w", errors.Join(errs...))
+}
+
+func fetchMetadataFrom(ctx context.Context, peer Peer, infoHash, clientID [20]byte) ([]byte, error) {
+	pc, err := dialPeer(peer, infoHash, clientID, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { pc.conn.Close() })
+	defer stop()
+
+	if !pc.handshake.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	pc.conn.SetDeadline(time.Now().Add(time.Minute))
+
+	hs, err := newExtHandshake(&ExtHandshake{M: map[string]int{utMetadata: utMetadataID}})
+	if err != nil {
+		return nil, err
+	}
+	if err := pc.send(hs); err != nil {
+		return nil, err
+	}
+
+	var peerHs ExtHandshake
+	for {
+		msg, err := pc.read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+		id, payload, err := ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if id != extHandshakeID {
+			continue
+		}
+		if err := bencode.Unmarshal(payload, &peerHs); err != nil {
+			return nil, fmt.Errorf("invalid extended handshake: %w", err)
+		}
+		break
+	}
+
+	peerID, ok := peerHs.M[utMetadata]
+	if !ok || peerID <= 0 || peerID > 255 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+
+	size := peerHs.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size: %d", size)
+	}
+
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for i := range numPieces {
+		payload, err := bencode.Marshal(metadataMessage{MsgType: metadataRequest, Piece: i})
+		if err != nil {
+			return nil, err
+		}
+		if err := pc.send(NewExtended(byte(peerID), payload)); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := make([]byte, size)
+	received := make([]bool, numPieces)
+	remaining := numPieces
+
+	for remaining > 0 {
+		msg, err := pc.read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+		id, payload, err := ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if id != utMetadataID {
+			continue
+		}
+
+		var mm metadataMessage
+		n, err := bencode.UnmarshalPrefix(payload, &mm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ut_metadata message: %w", err)
+		}
+
+		switch mm.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", mm.Piece)
+		case metadataData:
+		default:
+			continue
+		}
+
+		if mm.Piece < 0 || mm.Piece >= numPieces {
+			return nil, fmt.Errorf("metadata piece out of range: %d", mm.Piece)
+		}
+
+		data := payload[n:]
+		begin := mm.Piece * metadataPieceSize
+		if want := min(metadataPieceSize, size-begin); len(data) != want {
+			return nil, fmt.Errorf("metadata piece %d has wrong size: got %d, expected %d", mm.Piece, len(data), want)
+		}
+
+		if !received[mm.Piece] {
+			copy(metadata[begin:], data)
+			received[mm.Piece] = true
+			remaining--
+		}
+	}
+
+	// v2 torrents are known by their truncated SHA-256 info-hash
+	v2 := sha256.Sum256(metadata)
+	if sha1.Sum(metadata) != infoHash && [20]byte(v2[:20]) != infoHash {
+		return nil, errors.New("metadata does not match info hash")
+	}
+
+	return metadata, nil
+}
+
+// metadataExtension serves the info dictionary to peers that fetch it with
+// ut_metadata.
+type metadataExtension struct {
+	info []byte
+}
+
+func (e *metadataExtension) Name() string { return utMetadata }
+
+func (e *metadataExtension) Handshake(p ExtensionPeer, hs *ExtHandshake) error { return nil }
+
+func (e *metadataExtension) Close(p ExtensionPeer) {}
+
+func (e *metadataExtension) Handle(p ExtensionPeer, payload []byte) error {
+	var mm metadataMessage
+	if _, err := bencode.UnmarshalPrefix(payload, &mm); err != nil {
+		return err
+	}
+	if mm.MsgType != metadataRequest {
+		return nil
+	}
+
+	begin := mm.Piece * metadataPieceSize
+	if len(e.info) == 0 || mm.Piece < 0 || begin >= len(e.info) {
+		reject, err := bencode.Marshal(metadataMessage{MsgType: metadataReject, Piece: mm.Piece})
+		if err != nil {
+			return err
+		}
+		return p.SendExtended(utMetadata, reject)
+	}
+
+	header, err := bencode.Marshal(metadataMessage{
+		MsgType:   metadataData,
+		Piece:     mm.Piece,
+		TotalSize: len(e.info),
+	})
+	if err != nil {
+		return err
+	}
+	data := e.info[begin:min(begin+metadataPieceSize, len(e.info))]
+	return p.SendExtended(utMetadata, append(header, data...))
+}
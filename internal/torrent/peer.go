@@ -0,0 +1,284 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// peerConn is an established connection to a peer that has completed the
+// handshake for a torrent.
+type peerConn struct {
+	conn net.Conn
+	// peer.Choked is whether we choke the peer; requests from a choked peer
+	// are ignored. It is guarded by mu.
+	peer Peer
+	// handshake is the handshake received from the peer.
+	handshake *Handshake
+	// choked is whether the peer chokes us.
+	choked    bool
+	bitfield  bitfield
+	numPieces int
+
+	// fast is whether both sides support the fast extension. The pieces the
+	// peer allows us to request while choked, suggested to us, or rejected
+	// while not choking us are tracked by the connection's goroutine, as are
+	// the pieces we allow the peer to request while choked.
+	fast        bool
+	allowedFast bitfield
+	suggested   bitfield
+	rejected    bitfield
+	grantedFast bitfield
+
+	// mu guards our choking of the peer and its interest, which the choker
+	// reads and changes from its own goroutine.
+	mu         sync.Mutex
+	interested bool
+	// downloaded and uploaded count the block bytes exchanged with the peer.
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// lastBlock is when the peer last sent us a block, in Unix nanoseconds.
+	lastBlock atomic.Int64
+	// choker, if set, is told when the peer becomes interested.
+	choker *choker
+
+	// serve returns the data for a block requested by the peer. The peer's
+	// requests are ignored if it is nil.
+	serve func(BlockRequest) ([]byte, error)
+	// picker, if set, is kept up to date with the pieces the peer has.
+	picker *picker
+	ext    *extensionState
+	// wmu serializes writes, which may come from extensions as well as the
+	// connection's own goroutine.
+	wmu sync.Mutex
+	// unchokeSent is whether the peer was last told it is unchoked. It is
+	// guarded by wmu.
+	unchokeSent bool
+}
+
+func dialPeer(peer Peer, infoHash, peerID [20]byte, numPieces int) (*peerConn, error) {
+	conn, err := net.DialTimeout("tcp", peer.addr(), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	hs := newHandshake(infoHash, peerID)
+	if _, err := conn.Write(hs.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %w", err)
+	}
+
+	peerHandshake := new(Handshake)
+	if err := peerHandshake.Read(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	if peerHandshake.InfoHash != infoHash {
+		conn.Close()
+		return nil, fmt.Errorf("info hash mismatch for peer %s", peer.addr())
+	}
+
+	return newPeerConn(conn, peer, peerHandshake, numPieces), nil
+}
+
+func newPeerConn(conn net.Conn, peer Peer, hs *Handshake, numPieces int) *peerConn {
+	peer.Choked = true
+	pc := &peerConn{
+		conn:        conn,
+		peer:        peer,
+		handshake:   hs,
+		choked:      true,
+		bitfield:    newBitfield(numPieces),
+		numPieces:   numPieces,
+		fast:        hs.SupportsFast(),
+		allowedFast: newBitfield(numPieces),
+		suggested:   newBitfield(numPieces),
+		rejected:    newBitfield(numPieces),
+		grantedFast: newBitfield(numPieces),
+	}
+	pc.lastBlock.Store(time.Now().UnixNano())
+	return pc
+}
+
+func (pc *peerConn) send(msg *Message) error {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	return pc.write(msg)
+}
+
+// write writes msg within peerWriteTimeout. A failed write may have sent
+// part of the message, so the connection is closed. pc.wmu must be held.
+func (pc *peerConn) write(msg *Message) error {
+	pc.conn.SetWriteDeadline(time.Now().Add(peerWriteTimeout))
+	if _, err := pc.conn.Write(msg.Serialize()); err != nil {
+		pc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (pc *peerConn) close() error {
+	if pc.picker != nil {
+		pc.picker.removeBitfield(pc.bitfield)
+	}
+	pc.closeExtensions()
+	return pc.conn.Close()
+}
+
+func (pc *peerConn) read() (*Message, error) {
+	return ReadMessage(pc.conn)
+}
+
+// handle applies state changing messages (choke, unchoke, interested, have,
+// bitfield and those of the fast extension) to the connection, serves
+// requests and dispatches extended messages. Other messages are ignored.
+func (pc *peerConn) handle(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		pc.choked = true
+	case MsgUnchoke:
+		pc.choked = false
+	case MsgInterested:
+		pc.mu.Lock()
+		pc.interested = true
+		pc.mu.Unlock()
+		if pc.choker != nil {
+			pc.choker.interested(pc)
+		}
+	case MsgNotInterested:
+		pc.mu.Lock()
+		pc.interested = false
+		pc.mu.Unlock()
+	case MsgHave:
+		index, err := ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if pc.bitfield.HasPiece(index) {
+			return nil
+		}
+		pc.bitfield.SetPiece(index)
+		if pc.picker != nil {
+			pc.picker.addHave(index)
+		}
+	case MsgBitfield:
+		bf, err := ParseBitfield(msg)
+		if err != nil {
+			return err
+		}
+		if len(bf) != len(pc.bitfield) {
+			return fmt.Errorf("bitfield has wrong length: got %d, expected %d", len(bf), len(pc.bitfield))
+		}
+		if pc.picker != nil {
+			pc.picker.removeBitfield(pc.bitfield)
+			pc.picker.addBitfield(bf)
+		}
+		copy(pc.bitfield, bf)
+	case MsgRequest:
+		req, err := ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		return pc.serveRequest(req)
+	case MsgSuggest, MsgHaveAll, MsgHaveNone, MsgReject, MsgAllowedFast:
+		return pc.handleFast(msg)
+	case MsgExtended:
+		return pc.handleExtended(msg)
+	}
+
+	return nil
+}
+
+// serveRequest sends the requested block. Requests of a choked peer are
+// dropped unless in its allowed fast set, and peers with the fast extension
+// are told about dropped requests and about pieces we don't have.
+func (pc *peerConn) serveRequest(req BlockRequest) error {
+	if pc.serve == nil || pc.isChoked() && !pc.grantedFast.HasPiece(req.Index) {
+		return pc.reject(req)
+	}
+	block, err := pc.serve(req)
+	if errors.Is(err, errPieceUnavailable) && pc.fast {
+		return pc.reject(req)
+	}
+	if err != nil {
+		return err
+	}
+	pc.uploaded.Add(int64(len(block)))
+	return pc.send(NewPiece(req.Index, req.Begin, block))
+}
+
+// isChoked reports whether we choke the peer.
+func (pc *peerConn) isChoked() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.peer.Choked
+}
+
+func (pc *peerConn) isInterested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.interested
+}
+
+// setChoked chokes or unchokes the peer and reports whether the state
+// changed. The peer isn't told until sendChoke is called.
+func (pc *peerConn) setChoked(choked bool) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.peer.Choked == choked {
+		return false
+	}
+	pc.peer.Choked = choked
+	return true
+}
+
+// sendChoke tells the peer whether we choke it, unless it already knows.
+// Only the latest state is sent, so concurrent changes can't reach the peer
+// out of order.
+func (pc *peerConn) sendChoke() error {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+
+	choked := pc.isChoked()
+	if pc.unchokeSent == !choked {
+		return nil
+	}
+	msg := NewUnchoke()
+	if choked {
+		msg = NewChoke()
+	}
+	if err := pc.write(msg); err != nil {
+		return err
+	}
+	pc.unchokeSent = !choked
+	return nil
+}
+
+// snubbed reports whether the peer hasn't sent us a block for d.
+func (pc *peerConn) snubbed(d time.Duration) bool {
+	return time.Since(time.Unix(0, pc.lastBlock.Load())) > d
+}
+
+// update reads and handles a single message, waiting at most timeout.
+func (pc *peerConn) update(timeout time.Duration) error {
+	pc.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer pc.conn.SetReadDeadline(time.Time{})
+
+	msg, err := pc.read()
+	if err != nil {
+		return err
+	}
+	return pc.handle(msg)
+}
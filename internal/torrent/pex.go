@@ -0,0 +1,268 @@
+package torrent
+
+import (
+	"log"
+	"net"
+	"sync"
+	"test/pkg/bencode"
+	"time"
+)
+
+const (
+	utPex = "ut_pex"
+	// pexInterval is the minimum time between two PEX messages to a peer.
+	pexInterval = time.Minute
+	// pexMaxPeers is the maximum number of added and of dropped peers in a
+	// single message.
+	pexMaxPeers = 50
+)
+
+// PEX peer flags sent in added.f.
+const (
+	pexEncryption = 0x01
+	pexSeed       = 0x02
+	pexUTP        = 0x04
+	pexHolepunch  = 0x08
+	pexReachable  = 0x10
+)
+
+// pexMessage is the payload of a ut_pex message (BEP 11). Peers are in
+// compact form.
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// compactPeer encodes the peer in compact form, returning false for
+// addresses that aren't IP literals.
+func compactPeer(p Peer) ([]byte, bool) {
+	ip := net.ParseIP(p.IP)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return append(ip, byte(p.Port>>8), byte(p.Port)), true
+}
+
+// pexPeer is a connected peer as announced to other peers.
+type pexPeer struct {
+	Peer
+	// reachable is whether we connected to the peer, so it accepts incoming
+	// connections.
+	reachable bool
+}
+
+func newPexMessage(added []pexPeer, dropped []Peer) *pexMessage {
+	msg := &pexMessage{}
+
+	for _, p := range added {
+		b, ok := compactPeer(p.Peer)
+		if !ok {
+			continue
+		}
+		var flags byte
+		if p.reachable {
+			flags |= pexReachable
+		}
+		if len(b) == compactPeerLen {
+			msg.Added += string(b)
+			msg.AddedF += string([]byte{flags})
+		} else {
+			msg.Added6 += string(b)
+			msg.Added6F += string([]byte{flags})
+		}
+	}
+
+	for _, p := range dropped {
+		b, ok := compactPeer(p)
+		if !ok {
+			continue
+		}
+		if len(b) == compactPeerLen {
+			msg.Dropped += string(b)
+		} else {
+			msg.Dropped6 += string(b)
+		}
+	}
+
+	return msg
+}
+
+func (m *pexMessage) added() ([]Peer, error) {
+	peers, err := parsePeersCompact([]byte(m.Added), compactPeerLen)
+	if err != nil {
+		return nil, err
+	}
+	peers6, err := parsePeersCompact([]byte(m.Added6), compactPeer6Len)
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+// pexPeerState is what we told a single peer about the swarm.
+type pexPeerState struct {
+	sent map[string]Peer
+	stop chan struct{}
+	// inbound is whether the peer connected to us and was added to the
+	// announced peers by its extended handshake.
+	inbound bool
+}
+
+// pexExtension implements peer exchange (BEP 11). It tells every peer about
+// the peers we are connected to and hands the peers it learns about to
+// onPeers.
+type pexExtension struct {
+	onPeers  func([]Peer)
+	interval time.Duration
+
+	mu        sync.Mutex
+	connected map[string]pexPeer
+	peers     map[ExtensionPeer]*pexPeerState
+}
+
+func newPexExtension(onPeers func([]Peer)) *pexExtension {
+	return &pexExtension{
+		onPeers:   onPeers,
+		interval:  pexInterval,
+		connected: make(map[string]pexPeer),
+		peers:     make(map[ExtensionPeer]*pexPeerState),
+	}
+}
+
+func (e *pexExtension) Name() string { return utPex }
+
+// addConn records an outbound connection to peer, to be announced to other
+// peers as reachable.
+func (e *pexExtension) addConn(peer Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connected[peer.addr()] = pexPeer{Peer: peer, reachable: true}
+}
+
+func (e *pexExtension) removeConn(peer Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.connected, peer.addr())
+}
+
+func (e *pexExtension) Handshake(p ExtensionPeer, hs *ExtHandshake) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.peers[p]; ok {
+		return nil
+	}
+
+	state := &pexPeerState{sent: make(map[string]Peer), stop: make(chan struct{})}
+	e.peers[p] = state
+
+	// peers that connected to us are announced with the port they listen on,
+	// which we never tried
+	if _, ok := e.connected[p.Addr()]; !ok && hs.P > 0 && hs.P <= 65535 {
+		if host, _, err := net.SplitHostPort(p.Addr()); err == nil {
+			e.connected[p.Addr()] = pexPeer{Peer: Peer{IP: host, Port: uint16(hs.P)}}
+			state.inbound = true
+		}
+	}
+
+	go e.run(p, state)
+	return nil
+}
+
+func (e *pexExtension) Close(p ExtensionPeer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if state, ok := e.peers[p]; ok {
+		close(state.stop)
+		delete(e.peers, p)
+		if state.inbound {
+			delete(e.connected, p.Addr())
+		}
+	}
+}
+
+// diff returns the peers connected since and the peers dropped since the
+// last message to the peer at addr, and records them as sent.
+func (e *pexExtension) diff(addr string, state *pexPeerState) (added []pexPeer, dropped []Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for key, peer := range e.connected {
+		if len(added) == pexMaxPeers {
+			break
+		}
+		if _, ok := state.sent[key]; ok || key == addr {
+			continue
+		}
+		added = append(added, peer)
+		state.sent[key] = peer.Peer
+	}
+
+	for key, peer := range state.sent {
+		if len(dropped) == pexMaxPeers {
+			break
+		}
+		if _, ok := e.connected[key]; ok {
+			continue
+		}
+		dropped = append(dropped, peer)
+		delete(state.sent, key)
+	}
+
+	return added, dropped
+}
+
+func (e *pexExtension) run(p ExtensionPeer, state *pexPeerState) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		added, dropped := e.diff(p.Addr(), state)
+		if len(added) > 0 || len(dropped) > 0 {
+			payload, err := bencode.Marshal(newPexMessage(added, dropped))
+			if err != nil {
+				log.Printf("pex: %v", err)
+				return
+			}
+			if err := p.SendExtended(utPex, payload); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-state.stop:
+			return
+		}
+	}
+}
+
+func (e *pexExtension) Handle(p ExtensionPeer, payload []byte) error {
+	var msg pexMessage
+	if err := bencode.Unmarshal(payload, &msg); err != nil {
+		return err
+	}
+
+	peers, err := msg.added()
+	if err != nil {
+		return err
+	}
+	// no more than a well-behaved peer sends, so a single message can't
+	// flood us with addresses
+	if len(peers) > pexMaxPeers {
+		peers = peers[:pexMaxPeers]
+	}
+
+	if len(peers) > 0 && e.onPeers != nil {
+		e.onPeers(peers)
+	}
+	return nil
+}
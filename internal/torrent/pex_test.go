@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPexMessage_RoundTrip(t *testing.T) {
+	added := []pexPeer{
+		{Peer: Peer{IP: "10.0.0.1", Port: 6881}, reachable: true},
+		{Peer: Peer{IP: "10.0.0.3", Port: 6882}},
+		{Peer: Peer{IP: "2001:db8::1", Port: 51413}, reachable: true},
+	}
+	dropped := []Peer{{IP: "10.0.0.2", Port: 1}}
+
+	raw, err := bencode.Marshal(newPexMessage(added, dropped))
+	require.NoError(t, err)
+
+	var msg pexMessage
+	require.NoError(t, bencode.Unmarshal(raw, &msg))
+	require.Equal(t, string([]byte{pexReachable, 0}), msg.AddedF)
+	require.Equal(t, string([]byte{pexReachable}), msg.Added6F)
+	require.Equal(t, string([]byte{10, 0, 0, 2, 0, 1}), msg.Dropped)
+
+	got, err := msg.added()
+	require.NoError(t, err)
+	require.Equal(t, []Peer{added[0].Peer, added[1].Peer, added[2].Peer}, got)
+}
+
+func TestPex_Diff(t *testing.T) {
+	a, b, c := Peer{IP: "10.0.0.1", Port: 1}, Peer{IP: "10.0.0.2", Port: 2}, Peer{IP: "10.0.0.3", Port: 3}
+
+	e := newPexExtension(nil)
+	e.addConn(a)
+	e.addConn(b)
+
+	state := &pexPeerState{sent: make(map[string]Peer)}
+
+	// the receiving peer is never told about itself
+	added, dropped := e.diff(a.addr(), state)
+	require.Equal(t, []pexPeer{{Peer: b, reachable: true}}, added)
+	require.Empty(t, dropped)
+
+	added, dropped = e.diff(a.addr(), state)
+	require.Empty(t, added)
+	require.Empty(t, dropped)
+
+	e.removeConn(b)
+	e.addConn(c)
+
+	added, dropped = e.diff(a.addr(), state)
+	require.Equal(t, []pexPeer{{Peer: c, reachable: true}}, added)
+	require.Equal(t, []Peer{b}, dropped)
+}
+
+func TestPex_ExchangesPeers(t *testing.T) {
+	a, b := newConnPair(t)
+
+	pexA := newPexExtension(nil)
+	pexA.addConn(Peer{IP: "10.0.0.7", Port: 7000})
+	regA := NewExtensionRegistry()
+	require.NoError(t, regA.Register(pexA))
+
+	learned := make(chan []Peer, 1)
+	pexB := newPexExtension(func(p []Peer) { learned <- p })
+	regB := NewExtensionRegistry()
+	require.NoError(t, regB.Register(pexB))
+
+	require.NoError(t, a.startExtensions(regA, 0, 0))
+	require.NoError(t, b.startExtensions(regB, 0, 0))
+	defer a.close()
+	defer b.close()
+
+	// a learns that b supports ut_pex and starts sending to it
+	msg, err := a.read()
+	require.NoError(t, err)
+	require.NoError(t, a.handle(msg))
+
+	for {
+		msg, err := b.read()
+		require.NoError(t, err)
+		require.NoError(t, b.handle(msg))
+
+		select {
+		case peers := <-learned:
+			require.Equal(t, []Peer{{IP: "10.0.0.7", Port: 7000}}, peers)
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPex_InboundPeersAreNotReachable(t *testing.T) {
+	a, b := newConnPair(t)
+	defer a.close()
+	defer b.close()
+
+	a.peer = Peer{IP: "127.0.0.1", Port: 40000}
+
+	e := newPexExtension(nil)
+	e.addConn(Peer{IP: "10.0.0.1", Port: 1})
+	require.NoError(t, e.Handshake(a, &ExtHandshake{P: 6881}))
+
+	state := &pexPeerState{sent: make(map[string]Peer)}
+	added, _ := e.diff("10.0.0.9:9", state)
+	require.ElementsMatch(t, []pexPeer{
+		{Peer: Peer{IP: "10.0.0.1", Port: 1}, reachable: true},
+		{Peer: Peer{IP: "127.0.0.1", Port: 6881}},
+	}, added)
+
+	e.Close(a)
+	_, dropped := e.diff("10.0.0.9:9", state)
+	require.Equal(t, []Peer{{IP: "127.0.0.1", Port: 6881}}, dropped)
+}
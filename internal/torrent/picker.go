@@ -0,0 +1,178 @@
+package torrent
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// randomFirstPieces is the number of pieces picked at random before switching
+// to rarest first. Random pieces are quicker to complete, which gets us
+// something to trade with early on.
+const randomFirstPieces = 4
+
+// picker decides which piece a peer should download next. It tracks how
+// many connected peers have each piece and hands out the rarest piece a peer
+// has, breaking ties at random. Once every missing piece is being downloaded
+// it enters endgame mode and hands out pieces that are already in progress,
+// so a slow peer doesn't hold up the last pieces.
+type picker struct {
+	mu           sync.Mutex
+	availability []int
+	done         bitfield
+	// active is the number of peers downloading each piece.
+	active     []int
+	completed  int
+	missing    int
+	unassigned int
+}
+
+// newPicker returns a picker for numPieces pieces, of which the ones in have
+// are already done.
+func newPicker(numPieces int, have bitfield) *picker {
+	p := &picker{
+		availability: make([]int, numPieces),
+		done:         newBitfield(numPieces),
+		active:       make([]int, numPieces),
+	}
+	for i := range numPieces {
+		if have.HasPiece(i) {
+			p.done.SetPiece(i)
+			continue
+		}
+		p.missing++
+		p.unassigned++
+	}
+	return p
+}
+
+// addBitfield records the pieces of a newly known peer.
+func (p *picker) addBitfield(bf bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// removeBitfield forgets the pieces of a disconnected peer.
+func (p *picker) removeBitfield(bf bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]--
+		}
+	}
+}
+
+func (p *picker) addHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// pick assigns the next piece to download from a peer with the pieces in
+// has. It returns false if the peer has nothing we need right now. Every
+// picked piece must be given back with release or complete.
+func (p *picker) pick(has bitfield) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index, ok := -1, false
+	if p.unassigned > 0 {
+		index, ok = p.pickUnassigned(has)
+	} else if p.missing > 0 {
+		index, ok = p.pickEndgame(has)
+	}
+	if !ok {
+		return -1, false
+	}
+
+	if p.active[index] == 0 {
+		p.unassigned--
+	}
+	p.active[index]++
+	return index, true
+}
+
+func (p *picker) pickUnassigned(has bitfield) (int, bool) {
+	random := p.completed < randomFirstPieces
+
+	best, ties := -1, 0
+	for i := range p.availability {
+		if p.done.HasPiece(i) || p.active[i] > 0 || !has.HasPiece(i) {
+			continue
+		}
+
+		switch {
+		case best < 0 || !random && p.availability[i] < p.availability[best]:
+			best, ties = i, 1
+		case random || p.availability[i] == p.availability[best]:
+			// reservoir sampling keeps every candidate equally likely
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	return best, best >= 0
+}
+
+// pickEndgame picks the in-progress piece with the fewest peers on it.
+func (p *picker) pickEndgame(has bitfield) (int, bool) {
+	best := -1
+	for i := range p.active {
+		if p.done.HasPiece(i) || !has.HasPiece(i) {
+			continue
+		}
+		if best < 0 || p.active[i] < p.active[best] {
+			best = i
+		}
+	}
+	return best, best >= 0
+}
+
+// release gives back a piece whose download failed.
+func (p *picker) release(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active[index]--
+	if p.active[index] == 0 && !p.done.HasPiece(index) {
+		p.unassigned++
+	}
+}
+
+// complete marks a verified piece as done. It returns false if another peer
+// completed it first, in which case the data should be dropped.
+func (p *picker) complete(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active[index]--
+	if p.done.HasPiece(index) {
+		return false
+	}
+
+	p.done.SetPiece(index)
+	p.completed++
+	p.missing--
+	return true
+}
+
+// isDone reports whether the piece was completed, e.g. by another peer
+// during endgame.
+func (p *picker) isDone(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.done.HasPiece(index)
+}
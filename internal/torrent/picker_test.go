@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fullBitfield(numPieces int) bitfield {
+	bf := newBitfield(numPieces)
+	for i := range numPieces {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+func TestPicker_OnlyPicksPiecesThePeerHas(t *testing.T) {
+	p := newPicker(8, nil)
+
+	has := newBitfield(8)
+	has.SetPiece(5)
+
+	index, ok := p.pick(has)
+	require.True(t, ok)
+	require.Equal(t, 5, index)
+
+	_, ok = p.pick(newBitfield(8))
+	require.False(t, ok)
+}
+
+func TestPicker_RarestFirst(t *testing.T) {
+	const n = 10
+	have := newBitfield(n)
+	p := newPicker(n, have)
+
+	// get past the random first pieces
+	for range randomFirstPieces {
+		index, ok := p.pick(fullBitfield(n))
+		require.True(t, ok)
+		require.True(t, p.complete(index))
+	}
+
+	var rare int
+	for i := range n {
+		if !p.isDone(i) {
+			rare = i
+			break
+		}
+	}
+
+	// every piece but the rare one is seen twice as often
+	common := fullBitfield(n)
+	p.addBitfield(common)
+	p.addBitfield(common)
+	p.removeBitfield(common)
+	for i := range n {
+		if i != rare {
+			p.addHave(i)
+		}
+	}
+
+	index, ok := p.pick(fullBitfield(n))
+	require.True(t, ok)
+	require.Equal(t, rare, index)
+}
+
+func TestPicker_RandomTieBreak(t *testing.T) {
+	seen := make(map[int]bool)
+	for range 100 {
+		p := newPicker(4, nil)
+		index, ok := p.pick(fullBitfield(4))
+		require.True(t, ok)
+		seen[index] = true
+	}
+	require.Len(t, seen, 4)
+}
+
+func TestPicker_Endgame(t *testing.T) {
+	p := newPicker(2, nil)
+	all := fullBitfield(2)
+
+	a, ok := p.pick(all)
+	require.True(t, ok)
+	b, ok := p.pick(all)
+	require.True(t, ok)
+	require.NotEqual(t, a, b)
+
+	// every piece is in progress, so pieces get handed out twice
+	dup, ok := p.pick(all)
+	require.True(t, ok)
+
+	require.True(t, p.complete(dup))
+	require.True(t, p.isDone(dup))
+	require.False(t, p.complete(dup))
+
+	// a failed download puts the piece back
+	other := a + b - dup
+	p.release(other)
+	index, ok := p.pick(all)
+	require.True(t, ok)
+	require.Equal(t, other, index)
+	require.True(t, p.complete(index))
+
+	_, ok = p.pick(all)
+	require.False(t, ok)
+}
+
+func TestAttemptDownloadPiece_CancelsWhenDoneElsewhere(t *testing.T) {
+	a, b := newConnPair(t)
+	a.choked = false
+
+	pw := &pieceWork{index: 2, length: maxBlockSize + 100}
+
+	var done atomic.Bool
+	errc := make(chan error, 1)
+	go func() {
+		_, err := attemptDownloadPiece(a, pw, func(int) bool { return done.Load() })
+		errc <- err
+	}()
+
+	for range 2 {
+		msg, err := b.read()
+		require.NoError(t, err)
+		_, err = ParseRequest(msg)
+		require.NoError(t, err)
+	}
+
+	// another peer completes the piece while the first block arrives
+	done.Store(true)
+	require.NoError(t, b.send(NewPiece(2, 0, make([]byte, maxBlockSize))))
+
+	msg, err := b.read()
+	require.NoError(t, err)
+	req, err := ParseCancel(msg)
+	require.NoError(t, err)
+	require.Equal(t, BlockRequest{Index: 2, Begin: maxBlockSize, Length: 100}, req)
+
+	require.ErrorIs(t, <-errc, errPieceDone)
+}
@@ -0,0 +1,265 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"test/pkg/bencode"
+	"time"
+)
+
+const (
+	// resumeInterval is how often resume data is saved during a download, so
+	// a crash loses at most this much progress.
+	resumeInterval = time.Minute
+	// maxResumePeers bounds the peers kept in resume data.
+	maxResumePeers = 200
+)
+
+// resumeData is saved next to a download so a restart can continue where
+// it stopped. Binary values are bencode strings.
+type resumeData struct {
+	InfoHash string `bencode:"info hash"`
+	// Pieces is the bitfield of verified pieces.
+	Pieces string `bencode:"pieces"`
+	// Files is the state of the files the pieces were verified against, for
+	// storages backed by files.
+	Files []resumeFile `bencode:"files,omitempty"`
+	// Peers are the "host:port" addresses of the peers we knew.
+	Peers []string `bencode:"peers,omitempty"`
+	// Trackers are the tracker tiers in their last order, with the trackers
+	// that responded first.
+	Trackers   [][]string `bencode:"trackers,omitempty"`
+	Uploaded   int64      `bencode:"uploaded"`
+	Downloaded int64      `bencode:"downloaded"`
+}
+
+// resumeFile is the size and modification time of a file, in nanoseconds
+// since the epoch. Missing files have a size of -1.
+type resumeFile struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"`
+}
+
+// fileStater is implemented by storages whose files may change between
+// runs, so resume data can tell which pieces need rehashing.
+type fileStater interface {
+	statFiles() []resumeFile
+}
+
+func (s *fileStorage) statFiles() []resumeFile {
+	files := make([]resumeFile, len(s.tf.Files))
+	for i, f := range s.tf.Files {
+		if f.Padding {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(s.dir, filepath.Join(f.Path...)))
+		if err != nil {
+			files[i] = resumeFile{Size: -1}
+			continue
+		}
+		files[i] = resumeFile{Size: fi.Size(), MTime: fi.ModTime().UnixNano()}
+	}
+	return files
+}
+
+// resumePath is the file the torrent's resume data is kept in.
+func (tf *TorrentFile) resumePath() string {
+	return filepath.Join(tf.ResumeDir, hex.EncodeToString(tf.InfoHash[:])+".resume")
+}
+
+// loadResumeData reads the torrent's resume data. It returns nil if there is
+// none or it doesn't belong to the torrent.
+func (tf *TorrentFile) loadResumeData() *resumeData {
+	buf, err := os.ReadFile(tf.resumePath())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("ignoring resume data: %v", err)
+		}
+		return nil
+	}
+
+	rd := new(resumeData)
+	if err := bencode.Unmarshal(buf, rd); err != nil {
+		log.Printf("ignoring resume data: %v", err)
+		return nil
+	}
+	if rd.InfoHash != string(tf.InfoHash[:]) || len(rd.Pieces) != len(newBitfield(tf.numPieces())) {
+		log.Printf("ignoring resume data: not for torrent %x", tf.InfoHash)
+		return nil
+	}
+	return rd
+}
+
+// saveResumeData writes rd to the torrent's resume file. The file is
+// replaced atomically, so a crash mid-save leaves the previous data intact.
+func (tf *TorrentFile) saveResumeData(rd *resumeData) error {
+	buf, err := bencode.Marshal(rd)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tf.ResumeDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(tf.ResumeDir, ".resume-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), tf.resumePath())
+}
+
+// resumePieces returns the verified pieces in st. Pieces recorded in rd are
+// trusted without hashing unless a file they overlap changed since rd was
+// saved. If st can tell, unrecorded pieces of unchanged files are known to
+// be missing and aren't read either; every other piece is hashed.
+func (tf *TorrentFile) resumePieces(st TorrentStorage, rd *resumeData) bitfield {
+	trusted := newBitfield(tf.numPieces())
+	// known holds the pieces rd is right about, trusted or not
+	known := newBitfield(tf.numPieces())
+	if rd != nil {
+		copy(trusted, rd.Pieces)
+		copy(known, rd.Pieces)
+		if stater, ok := st.(fileStater); ok {
+			for i := range tf.numPieces() {
+				known.SetPiece(i)
+			}
+			files := stater.statFiles()
+			for i, f := range tf.Files {
+				if f.Length == 0 || i < len(rd.Files) && rd.Files[i] == files[i] {
+					continue
+				}
+				first, last := f.Offset/tf.PieceLength, (f.Offset+f.Length-1)/tf.PieceLength
+				for index := first; index <= last; index++ {
+					trusted.ClearPiece(index)
+					known.ClearPiece(index)
+				}
+			}
+		}
+	}
+
+	// nothing is cancelled, so every piece is checked
+	states, _ := tf.checkPieces(context.Background(), st, known)
+
+	have := newBitfield(tf.numPieces())
+	for i, ps := range states {
+		good := ps == PieceGood
+		if known.HasPiece(i) {
+			good = trusted.HasPiece(i)
+		}
+		if good {
+			have.SetPiece(i)
+		}
+	}
+	return have
+}
+
+// resumeData snapshots the session for a restart. The pieces are taken
+// before the files are stat'ed, so every recorded piece was written before
+// the recorded file state.
+func (s *session) resumeData() *resumeData {
+	s.mu.Lock()
+	pieces := string(s.have)
+	peers := slices.Sorted(maps.Keys(s.known))
+	s.mu.Unlock()
+
+	rd := &resumeData{
+		InfoHash:   string(s.tf.InfoHash[:]),
+		Pieces:     pieces,
+		Peers:      peers[:min(len(peers), maxResumePeers)],
+		Trackers:   s.trackers.Tiers(),
+		Uploaded:   s.uploaded.Load(),
+		Downloaded: s.downloaded.Load(),
+	}
+	if stater, ok := s.storage.(fileStater); ok {
+		rd.Files = stater.statFiles()
+	}
+	return rd
+}
+
+// saveResume saves the session's resume data, if the torrent keeps any.
+func (s *session) saveResume() {
+	if s.tf.ResumeDir == "" {
+		return
+	}
+	if err := s.tf.saveResumeData(s.resumeData()); err != nil {
+		log.Printf("saving resume data failed: %v", err)
+	}
+}
+
+// runResume saves resume data every resumeInterval until ctx is cancelled.
+func (s *session) runResume(ctx context.Context) {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.saveResume()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restore carries the transfer counters and tracker order of rd over to the
+// session and returns the peers it knew.
+func (s *session) restore(rd *resumeData) []Peer {
+	s.uploaded.Store(rd.Uploaded)
+	s.downloaded.Store(rd.Downloaded)
+	s.trackers.restore(rd.Trackers)
+
+	peers := make([]Peer, 0, len(rd.Peers))
+	for _, addr := range rd.Peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: host, Port: uint16(portNum)})
+	}
+	return peers
+}
+
+// openResumable opens the torrent's storage and the pieces already in it,
+// along with the resume data they were taken from, if any. Without a
+// ResumeDir, verify decides whether the data is hashed or assumed missing.
+func (tf *TorrentFile) openResumable(verify bool) (TorrentStorage, bitfield, *resumeData, error) {
+	st, err := tf.openStorage()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if tf.ResumeDir != "" {
+		rd := tf.loadResumeData()
+		return st, tf.resumePieces(st, rd), rd, nil
+	}
+	if verify {
+		return st, tf.verifiedPieces(st), nil, nil
+	}
+	return st, nil, nil, nil
+}
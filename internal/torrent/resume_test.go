@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumePieces(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	dir := t.TempDir()
+
+	tf := newMultiFileTorrent(t, data)
+	tf.ResumeDir = dir
+
+	st, err := FileStorage{Dir: dir}.Open(tf)
+	require.NoError(t, err)
+	defer st.Close()
+	for i := range tf.Pieces {
+		begin, end := tf.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+
+	s := newSession(tf, [20]byte{}, 0, st, tf.verifiedPieces(st))
+	require.NoError(t, tf.saveResumeData(s.resumeData()))
+
+	rd := tf.loadResumeData()
+	require.NotNil(t, rd)
+
+	// corrupting a file without touching its size or mtime goes unnoticed,
+	// showing that recorded pieces aren't rehashed
+	a := filepath.Join(dir, "root", "a")
+	fi, err := os.Stat(a)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(a, []byte("xxxxxxx"), 0o644))
+	require.NoError(t, os.Chtimes(a, fi.ModTime(), fi.ModTime()))
+
+	have := tf.resumePieces(st, rd)
+	for i := range tf.Pieces {
+		require.True(t, have.HasPiece(i))
+	}
+
+	// a modified file gets the pieces it overlaps rehashed
+	b := filepath.Join(dir, "root", "sub", "b")
+	require.NoError(t, os.WriteFile(b, bytes.Repeat([]byte("y"), len(data)-7), 0o644))
+	require.NoError(t, os.Chtimes(b, time.Now(), time.Now().Add(time.Hour)))
+
+	have = tf.resumePieces(st, rd)
+	require.False(t, have.HasPiece(0))
+	require.False(t, have.HasPiece(1))
+	require.False(t, have.HasPiece(2))
+	require.False(t, have.HasPiece(3))
+}
+
+// countingStorage counts the reads of a file storage.
+type countingStorage struct {
+	*fileStorage
+	reads atomic.Int32
+}
+
+func (s *countingStorage) ReadAt(p []byte, piece, off int) error {
+	s.reads.Add(1)
+	return s.fileStorage.ReadAt(p, piece, off)
+}
+
+func TestResumePieces_MissingPiecesAreNotRead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	dir := t.TempDir()
+
+	tf := newMultiFileTorrent(t, data)
+	tf.ResumeDir = dir
+
+	fs, err := FileStorage{Dir: dir}.Open(tf)
+	require.NoError(t, err)
+	defer fs.Close()
+	st := &countingStorage{fileStorage: fs.(*fileStorage)}
+
+	// only the first two of four pieces were downloaded
+	for i := range 2 {
+		begin, end := tf.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+	s := newSession(tf, [20]byte{}, 0, st, tf.verifiedPieces(st))
+	require.NoError(t, tf.saveResumeData(s.resumeData()))
+	rd := tf.loadResumeData()
+	require.NotNil(t, rd)
+
+	st.reads.Store(0)
+	have := tf.resumePieces(st, rd)
+	require.Zero(t, st.reads.Load())
+	require.Equal(t, []bool{true, true, false, false}, []bool{have.HasPiece(0), have.HasPiece(1), have.HasPiece(2), have.HasPiece(3)})
+}
+
+func TestLoadResumeData_OtherTorrent(t *testing.T) {
+	dir := t.TempDir()
+
+	other := newTestTorrent(t, "other", []byte("other data"), 4)
+	other.ResumeDir = dir
+	s := newSession(other, [20]byte{}, 0, nil, nil)
+	require.NoError(t, other.saveResumeData(s.resumeData()))
+
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	tf.ResumeDir = dir
+	require.NoError(t, os.Rename(other.resumePath(), tf.resumePath()))
+
+	require.Nil(t, tf.loadResumeData())
+}
+
+func TestDownloadContext_Resume(t *testing.T) {
+	data := bytes.Repeat([]byte("resume me "), 10000)
+	dir := t.TempDir()
+
+	tf := newTestTorrent(t, "out.bin", data, 32768)
+	tf.Announce = newEmptyTracker(t).URL + "/announce"
+	tf.Storage = FileStorage{Dir: dir}
+	tf.ResumeDir = dir
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "out.bin"), data, 0o644))
+
+	st, err := tf.openStorage()
+	require.NoError(t, err)
+	have := tf.verifiedPieces(st)
+	s := newSession(tf, [20]byte{}, 0, st, have)
+	s.known["10.0.0.1:6881"] = true
+	s.uploaded.Store(1234)
+	require.NoError(t, tf.saveResumeData(s.resumeData()))
+	require.NoError(t, st.Close())
+
+	// every piece is known to be done, so there is nothing to download even
+	// though the tracker has no peers
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, tf.DownloadContext(ctx, [20]byte{'l'}, 0))
+
+	rd := tf.loadResumeData()
+	require.NotNil(t, rd)
+	require.Equal(t, []string{"10.0.0.1:6881"}, rd.Peers)
+	require.Equal(t, int64(1234), rd.Uploaded)
+	require.Equal(t, string(have), rd.Pieces)
+}
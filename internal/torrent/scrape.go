@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"test/pkg/bencode"
+)
+
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// Scraper is implemented by trackers that can report swarm statistics
+// without announcing (BEP 48).
+type Scraper interface {
+	Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error)
+}
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL
+// by replacing "announce" at the start of the last path segment with
+// "scrape".
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	last := u.Path[i+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("%w: %s", ErrScrapeNotSupported, announce)
+	}
+
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+type scrapeResponse struct {
+	FailureReason string                 `bencode:"failure reason"`
+	Files         map[string]ScrapeStats `bencode:"files"`
+}
+
+func (t *HTTPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error) {
+	scrapeURL, err := ScrapeURL(t.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	v := u.Query()
+	for _, hash := range infoHashes {
+		v.Add("info_hash", string(hash[:]))
+	}
+	u.RawQuery = v.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response scrapeResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	if response.FailureReason != "" {
+		return nil, errors.New(response.FailureReason)
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(response.Files))
+	for key, s := range response.Files {
+		if len(key) != 20 {
+			return nil, fmt.Errorf("invalid info hash in scrape response: %x", key)
+		}
+		stats[[20]byte([]byte(key))] = s
+	}
+
+	return stats, nil
+}
+
+// Scrape requests swarm statistics from the tracker at the announce URL.
+func Scrape(ctx context.Context, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error) {
+	tr, err := NewTracker(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	if c, ok := tr.(interface{ Close() error }); ok {
+		defer c.Close()
+	}
+
+	s, ok := tr.(Scraper)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrScrapeNotSupported, announce)
+	}
+	return s.Scrape(ctx, infoHashes...)
+}
@@ -0,0 +1,59 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := []struct {
+		announce string
+		want     string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	}
+
+	for _, tc := range cases {
+		got, err := ScrapeURL(tc.announce)
+		if tc.want == "" {
+			require.ErrorIs(t, err, ErrScrapeNotSupported, tc.announce)
+			continue
+		}
+		require.NoError(t, err, tc.announce)
+		require.Equal(t, tc.want, got)
+	}
+}
+
+func TestHTTPTracker_Scrape(t *testing.T) {
+	a, b := [20]byte{'a'}, [20]byte{'b'}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/scrape", r.URL.Path)
+		require.ElementsMatch(t, []string{string(a[:]), string(b[:])}, r.URL.Query()["info_hash"])
+
+		buf, _ := bencode.Marshal(map[string]any{"files": map[string]any{
+			string(a[:]): map[string]any{"complete": 5, "downloaded": 50, "incomplete": 10},
+			string(b[:]): map[string]any{"complete": 1, "downloaded": 2, "incomplete": 3},
+		}})
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	stats, err := Scrape(context.Background(), srv.URL+"/announce", a, b)
+	require.NoError(t, err)
+	require.Equal(t, map[[20]byte]ScrapeStats{
+		a: {Complete: 5, Downloaded: 50, Incomplete: 10},
+		b: {Complete: 1, Downloaded: 2, Incomplete: 3},
+	}, stats)
+}
@@ -0,0 +1,242 @@
+package torrent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage opens the store of a torrent's data. Implementations decide where
+// the data lives, e.g. in files on disk, an object store or a database.
+type Storage interface {
+	Open(tf *TorrentFile) (TorrentStorage, error)
+}
+
+// TorrentStorage holds the data of a single torrent, addressed by piece
+// index and offset within the piece. It must be safe for concurrent use.
+type TorrentStorage interface {
+	// ReadAt fills p with the data at offset off of the piece.
+	ReadAt(p []byte, piece, off int) error
+	// WriteAt stores p at offset off of the piece.
+	WriteAt(p []byte, piece, off int) error
+	// MarkComplete is called once a piece was written and verified.
+	MarkComplete(piece int) error
+	Close() error
+}
+
+// openStorage opens the torrent's Storage, defaulting to files under the
+// current directory.
+func (tf *TorrentFile) openStorage() (TorrentStorage, error) {
+	if tf.Storage != nil {
+		return tf.Storage.Open(tf)
+	}
+	return FileStorage{Dir: "."}.Open(tf)
+}
+
+// verifiedPieces hashes the pieces in st and returns the ones that match.
+func (tf *TorrentFile) verifiedPieces(st TorrentStorage) bitfield {
+	return tf.resumePieces(st, nil)
+}
+
+// FileStorage stores torrent data in files under Dir, laid out as described
+// by the torrent.
+type FileStorage struct {
+	Dir string
+}
+
+func (fs FileStorage) Open(tf *TorrentFile) (TorrentStorage, error) {
+	return &fileStorage{
+		tf:    tf,
+		dir:   fs.Dir,
+		files: make(map[string]*os.File),
+	}, nil
+}
+
+type fileStorage struct {
+	tf  *TorrentFile
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// file returns the open file at the torrent path. Files are only created
+// when create is set, so reading missing data fails.
+func (s *fileStorage) file(path []string, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := filepath.Join(s.dir, filepath.Join(path...))
+	if f, ok := s.files[name]; ok {
+		return f, nil
+	}
+
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+
+	f, err := os.OpenFile(name, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.files[name] = f
+	return f, nil
+}
+
+func (s *fileStorage) ReadAt(p []byte, piece, off int) error {
+	begin, err := s.tf.pieceOffset(piece, off, len(p))
+	if err != nil {
+		return err
+	}
+	spans, err := s.tf.spans(begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	for _, span := range spans {
+		if span.file.Padding {
+			clear(p[:span.n])
+			p = p[span.n:]
+			continue
+		}
+		f, err := s.file(span.file.Path, false)
+		if err != nil {
+			return err
+		}
+		if _, err := f.ReadAt(p[:span.n], int64(span.off)); err != nil {
+			return err
+		}
+		p = p[span.n:]
+	}
+	return nil
+}
+
+func (s *fileStorage) WriteAt(p []byte, piece, off int) error {
+	begin, err := s.tf.pieceOffset(piece, off, len(p))
+	if err != nil {
+		return err
+	}
+	spans, err := s.tf.spans(begin, len(p))
+	if err != nil {
+		return err
+	}
+
+	for _, span := range spans {
+		if span.file.Padding {
+			p = p[span.n:]
+			continue
+		}
+		f, err := s.file(span.file.Path, true)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(p[:span.n], int64(span.off)); err != nil {
+			return err
+		}
+		p = p[span.n:]
+	}
+	return nil
+}
+
+// MarkComplete creates the empty files at the piece, which no write ever
+// creates. Other than that the files are all there is to a piece.
+func (s *fileStorage) MarkComplete(piece int) error {
+	for _, f := range s.tf.Files {
+		if f.Length > 0 || f.Padding || min(f.Offset/s.tf.PieceLength, s.tf.numPieces()-1) != piece {
+			continue
+		}
+		if _, err := s.file(f.Path, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exists reports whether the file at the torrent path exists.
+func (s *fileStorage) exists(path []string) bool {
+	_, err := os.Stat(filepath.Join(s.dir, filepath.Join(path...)))
+	return err == nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for name, f := range s.files {
+		errs = append(errs, f.Close())
+		delete(s.files, name)
+	}
+	return errors.Join(errs...)
+}
+
+// MemoryStorage keeps torrent data in memory, keyed by info-hash, so a
+// torrent opened twice sees the same data. It is meant for tests.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	torrents map[[20]byte]*memoryStorage
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{torrents: make(map[[20]byte]*memoryStorage)}
+}
+
+func (m *MemoryStorage) Open(tf *TorrentFile) (TorrentStorage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st, ok := m.torrents[tf.InfoHash]; ok {
+		return st, nil
+	}
+	st := &memoryStorage{
+		tf:  tf,
+		buf: make([]byte, tf.Length),
+	}
+	m.torrents[tf.InfoHash] = st
+	return st, nil
+}
+
+type memoryStorage struct {
+	tf *TorrentFile
+
+	mu  sync.RWMutex
+	buf []byte
+}
+
+func (s *memoryStorage) ReadAt(p []byte, piece, off int) error {
+	begin, err := s.tf.pieceOffset(piece, off, len(p))
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	copy(p, s.buf[begin:])
+	return nil
+}
+
+func (s *memoryStorage) WriteAt(p []byte, piece, off int) error {
+	begin, err := s.tf.pieceOffset(piece, off, len(p))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.buf[begin:], p)
+	return nil
+}
+
+// MarkComplete does nothing, the data is all there is to a piece.
+func (s *memoryStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newMultiFileTorrent returns a torrent of three files whose pieces straddle
+// the file boundaries.
+func newMultiFileTorrent(t *testing.T, data []byte) *TorrentFile {
+	t.Helper()
+
+	tf := newTestTorrent(t, "root", data, 16)
+	tf.Files = []File{
+		{Path: []string{"root", "a"}, Length: 7, Offset: 0},
+		{Path: []string{"root", "empty"}, Length: 0, Offset: 7},
+		{Path: []string{"root", "sub", "b"}, Length: len(data) - 7, Offset: 7},
+	}
+	return tf
+}
+
+func TestStorage_ReadWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+
+	storages := map[string]Storage{
+		"file":   FileStorage{Dir: t.TempDir()},
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			tf := newMultiFileTorrent(t, data)
+			st, err := storage.Open(tf)
+			require.NoError(t, err)
+			defer st.Close()
+
+			for i := range tf.Pieces {
+				begin, end := tf.pieceBounds(i)
+				require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+				require.NoError(t, st.MarkComplete(i))
+			}
+			if fs, ok := storage.(FileStorage); ok {
+				require.FileExists(t, filepath.Join(fs.Dir, "root", "empty"))
+			}
+
+			buf := make([]byte, 10)
+			require.NoError(t, st.ReadAt(buf, 0, 3))
+			require.Equal(t, data[3:13], buf)
+
+			require.Error(t, st.ReadAt(buf, 3, 0))
+			require.Error(t, st.WriteAt(buf, 4, 0))
+
+			have := tf.verifiedPieces(st)
+			for i := range tf.Pieces {
+				require.True(t, have.HasPiece(i))
+			}
+		})
+	}
+}
+
+func TestFileStorage_MissingData(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+
+	st, err := FileStorage{Dir: t.TempDir()}.Open(tf)
+	require.NoError(t, err)
+	defer st.Close()
+
+	require.Error(t, st.ReadAt(make([]byte, 4), 0, 0))
+	require.Equal(t, newBitfield(len(tf.Pieces)), tf.verifiedPieces(st))
+}
+
+func TestDownload_FromSeed(t *testing.T) {
+	data := bytes.Repeat([]byte("seed me "), 20000)
+
+	seed := newTestTorrent(t, "out.bin", data, 32768)
+	seed.Storage = NewMemoryStorage()
+	st, err := seed.Storage.Open(seed)
+	require.NoError(t, err)
+	for i := range seed.Pieces {
+		begin, end := seed.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+
+	ln, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	seed.Listener = ln
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{
+			"interval": 1800,
+			"peers":    []any{map[string]any{"ip": "127.0.0.1", "port": ln.Addr().(*net.TCPAddr).Port}},
+		})
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+	seed.Announce = tracker.URL + "/announce"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- seed.Seed(ctx, [20]byte{'s'}, 0) }()
+	require.Eventually(t, func() bool { return ln.session(seed.InfoHash) != nil }, 5*time.Second, 10*time.Millisecond)
+
+	leech := newTestTorrent(t, "out.bin", data, 32768)
+	leech.Announce = seed.Announce
+	storage := NewMemoryStorage()
+	leech.Storage = storage
+	require.NoError(t, leech.Download([20]byte{'l'}, 0))
+
+	got, err := storage.Open(leech)
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	for i := range leech.Pieces {
+		begin, end := leech.pieceBounds(i)
+		require.NoError(t, got.ReadAt(buf[begin:end], i, 0))
+	}
+	require.Equal(t, data, buf)
+	r, err := leech.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+
+	cancel()
+	require.NoError(t, <-errc)
+}
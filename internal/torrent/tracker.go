@@ -1,21 +1,272 @@
 package torrent
 
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"test/pkg/bencode"
+	"time"
+)
+
 type Peer struct {
 	PeerID *string `bencode:"peer id"`
 	IP     string  `bencode:"ip"`
 	Port   uint16  `bencode:"port"`
+	// Choked is whether we choke the peer, driven by the choker once we are
+	// connected.
 	Choked bool
 }
 
+func (p *Peer) addr() string {
+	return net.JoinHostPort(p.IP, strconv.Itoa(int(p.Port)))
+}
+
+const (
+	compactPeerLen  = 6
+	compactPeer6Len = 18
+)
+
+// PeerList is the "peers" value of a tracker response. Trackers send it either
+// as a list of dictionaries or, in compact form (BEP 23), as a string of
+// 6-byte IPv4 address and port pairs.
+type PeerList []Peer
+
+func (pl *PeerList) UnmarshalBencode(b []byte) error {
+	if len(b) > 0 && b[0] == 'l' {
+		var peers []Peer
+		if err := bencode.Unmarshal(b, &peers); err != nil {
+			return err
+		}
+		*pl = peers
+		return nil
+	}
+
+	var compact []byte
+	if err := bencode.Unmarshal(b, &compact); err != nil {
+		return err
+	}
+
+	peers, err := parsePeersCompact(compact, compactPeerLen)
+	if err != nil {
+		return err
+	}
+	*pl = peers
+	return nil
+}
+
+// PeerList6 is the "peers6" value of a tracker response: a string of 18-byte
+// IPv6 address and port pairs.
+type PeerList6 []Peer
+
+func (pl *PeerList6) UnmarshalBencode(b []byte) error {
+	var compact []byte
+	if err := bencode.Unmarshal(b, &compact); err != nil {
+		return err
+	}
+
+	peers, err := parsePeersCompact(compact, compactPeer6Len)
+	if err != nil {
+		return err
+	}
+	*pl = peers
+	return nil
+}
+
 type TrackerResponse struct {
-	FailureReason  string `bencode:"failure reason"`
-	WarningMessage string `bencode:"warning reason"`
-	Interval       int    `bencode:"interval"`
-	MinInterval    int    `bencode:"min interval"`
-	TrackerID      string `bencode:"tracker id"`
-	Complete       int    `bencode:"complete"`
-	Incomplete     int    `bencode:"incomplete"`
-	Peers          []Peer `bencode:"peers"`
-	Peers6         string `bencode:"peers6"`
-	// Peers  []byte `bencode:"peers"`
+	FailureReason  string    `bencode:"failure reason"`
+	WarningMessage string    `bencode:"warning message"`
+	Interval       int       `bencode:"interval"`
+	MinInterval    int       `bencode:"min interval"`
+	TrackerID      string    `bencode:"tracker id"`
+	Complete       int       `bencode:"complete"`
+	Incomplete     int       `bencode:"incomplete"`
+	Peers          PeerList  `bencode:"peers"`
+	Peers6         PeerList6 `bencode:"peers6"`
+}
+
+// AllPeers returns both the IPv4 and IPv6 peers of the response.
+func (r *TrackerResponse) AllPeers() []Peer {
+	peers := make([]Peer, 0, len(r.Peers)+len(r.Peers6))
+	peers = append(peers, r.Peers...)
+	return append(peers, r.Peers6...)
+}
+
+// parsePeersCompact parses peers in compact form, where each peer is a
+// big-endian address of size-2 bytes followed by a 2-byte port.
+func parsePeersCompact(peers []byte, size int) ([]Peer, error) {
+	if len(peers)%size != 0 {
+		return nil, fmt.Errorf("peers received in wrong format: not divisible by %d - %d", size, len(peers))
+	}
+
+	numPeers := len(peers) / size
+	parsed := make([]Peer, numPeers)
+
+	for i := range parsed {
+		b := peers[i*size : (i+1)*size]
+		parsed[i] = Peer{
+			IP:   net.IP(b[:size-2]).String(),
+			Port: binary.BigEndian.Uint16(b[size-2:]),
+		}
+	}
+
+	return parsed, nil
+}
+
+// Event is the announce event sent to a tracker.
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// NumWant is the number of peers wanted, or 0 for the tracker default.
+	NumWant int
+	// Key identifies the client across IP address changes.
+	Key uint32
+}
+
+// ScrapeStats is the swarm state of a single torrent as reported by a scrape.
+type ScrapeStats struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Tracker announces to a single tracker URL.
+type Tracker interface {
+	Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error)
+}
+
+// NewTracker returns the tracker client for the announce URL's scheme.
+func NewTracker(announce string) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPTracker{URL: announce}, nil
+	case "udp":
+		return NewUDPTracker(u.Host), nil
+	}
+
+	return nil, fmt.Errorf("unsupported tracker scheme: %q", u.Scheme)
+}
+
+// defaultTrackerClient is used by HTTPTrackers without a Client.
+var defaultTrackerClient = &http.Client{Timeout: 30 * time.Second}
+
+type HTTPTracker struct {
+	URL string
+	// Client is used for announces, defaultTrackerClient if nil.
+	Client *http.Client
+
+	mu sync.Mutex
+	// trackerID is echoed back to the tracker on subsequent announces.
+	trackerID string
+}
+
+func (t *HTTPTracker) buildURL(req *AnnounceRequest) (*url.URL, error) {
+	parsed, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	v := parsed.Query()
+	v.Set("info_hash", string(req.InfoHash[:]))
+	v.Set("peer_id", string(req.PeerID[:]))
+	v.Set("port", strconv.Itoa(int(req.Port)))
+	v.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	v.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	v.Set("left", strconv.FormatInt(req.Left, 10))
+	v.Set("compact", "1")
+	if req.Event != EventNone {
+		v.Set("event", req.Event.String())
+	}
+	if req.NumWant > 0 {
+		v.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		v.Set("key", strconv.FormatUint(uint64(req.Key), 16))
+	}
+	t.mu.Lock()
+	if t.trackerID != "" {
+		v.Set("trackerid", t.trackerID)
+	}
+	t.mu.Unlock()
+	parsed.RawQuery = v.Encode()
+
+	return parsed, nil
+}
+
+func (t *HTTPTracker) client() *http.Client {
+	if t.Client != nil {
+		return t.Client
+	}
+	return defaultTrackerClient
+}
+
+func (t *HTTPTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	trackerURL, err := t.buildURL(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, trackerURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response TrackerResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	if response.FailureReason != "" {
+		return nil, errors.New(response.FailureReason)
+	}
+
+	if response.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = response.TrackerID
+		t.mu.Unlock()
+	}
+
+	return &response, nil
 }
@@ -0,0 +1,214 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// trackerTimeout bounds a single announce attempt, so that a tracker that
+// never answers doesn't keep the others from being tried. UDP trackers get
+// enough time for their first retransmission instead, see timeout.
+const trackerTimeout = 15 * time.Second
+
+// TrackerList announces to the tiers of an announce-list (BEP 12). Trackers
+// within a tier are shuffled once and tried in order; a tracker that responds
+// is moved to the front of its tier. The next tier is only tried when every
+// tracker of the previous one failed. A regular announce to a tracker that
+// wasn't sent the started event, e.g. after failing over to it, is sent as
+// started instead.
+type TrackerList struct {
+	// Timeout bounds the announce to every tracker. If zero, it is
+	// trackerTimeout, or longer for UDP trackers.
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	tiers    [][]string
+	trackers map[string]Tracker
+	// started holds the trackers that accepted the started event and
+	// haven't been sent stopped since.
+	started map[string]bool
+}
+
+func NewTrackerList(tiers [][]string) *TrackerList {
+	tl := &TrackerList{
+		trackers: make(map[string]Tracker),
+		started:  make(map[string]bool),
+	}
+
+	for _, tier := range tiers {
+		urls := make([]string, 0, len(tier))
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+		tl.tiers = append(tl.tiers, urls)
+	}
+
+	return tl
+}
+
+// Tiers returns a copy of the tiers in their current order.
+func (tl *TrackerList) Tiers() [][]string {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tiers := make([][]string, len(tl.tiers))
+	for i, tier := range tl.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// restore reorders every tier to match the same tier of saved, e.g. from a
+// previous run. Tiers whose trackers changed keep their order.
+func (tl *TrackerList) restore(saved [][]string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	for i, tier := range tl.tiers {
+		if i >= len(saved) || len(saved[i]) != len(tier) {
+			continue
+		}
+		if !slices.Equal(slices.Sorted(slices.Values(saved[i])), slices.Sorted(slices.Values(tier))) {
+			continue
+		}
+		copy(tier, saved[i])
+	}
+}
+
+func (tl *TrackerList) tracker(url string) (Tracker, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tr, ok := tl.trackers[url]; ok {
+		return tr, nil
+	}
+	tr, err := NewTracker(url)
+	if err != nil {
+		return nil, err
+	}
+	tl.trackers[url] = tr
+	return tr, nil
+}
+
+// Close releases the trackers' resources, e.g. the sockets of UDP trackers.
+func (tl *TrackerList) Close() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	var errs []error
+	for url, tr := range tl.trackers {
+		if c, ok := tr.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+		delete(tl.trackers, url)
+	}
+	return errors.Join(errs...)
+}
+
+// promote moves url to the front of tier i.
+func (tl *TrackerList) promote(i int, url string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tier := tl.tiers[i]
+	for j, u := range tier {
+		if u == url {
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = url
+			return
+		}
+	}
+}
+
+// Announce announces to the first tracker that responds.
+func (tl *TrackerList) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	var errs []error
+
+	for i, tier := range tl.Tiers() {
+		for _, url := range tier {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			tr, err := tl.tracker(url)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			r := *req
+			r.Event = tl.event(url, req.Event)
+			resp, err := tl.announce(ctx, tr, &r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", url, err))
+				continue
+			}
+
+			tl.promote(i, url)
+			tl.sent(url, r.Event)
+			return resp, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no trackers to announce to")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// event returns the event to send to url in place of event.
+func (tl *TrackerList) event(url string, event Event) Event {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if event == EventNone && !tl.started[url] {
+		return EventStarted
+	}
+	return event
+}
+
+// sent records that url accepted event.
+func (tl *TrackerList) sent(url string, event Event) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	switch event {
+	case EventStarted:
+		tl.started[url] = true
+	case EventStopped:
+		delete(tl.started, url)
+	}
+}
+
+// timeout returns how long an announce to tr may take.
+func (tl *TrackerList) timeout(tr Tracker) time.Duration {
+	if tl.Timeout != 0 {
+		return tl.Timeout
+	}
+	if udp, ok := tr.(*UDPTracker); ok {
+		// the request and one retransmission, which waits twice as long
+		// (BEP 15)
+		return udp.Timeout + udp.Timeout<<1
+	}
+	return trackerTimeout
+}
+
+func (tl *TrackerList) announce(ctx context.Context, tr Tracker, req *AnnounceRequest) (*TrackerResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, tl.timeout(tr))
+	defer cancel()
+	return tr.Announce(ctx, req)
+}
@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTrackerServer(t *testing.T, interval int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{"interval": interval, "peers": ""})
+		w.Write(buf)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newDeadTracker() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL + "/announce"
+}
+
+func TestTrackerList_PromotesWorkingTracker(t *testing.T) {
+	good := newTrackerServer(t, 10).URL + "/announce"
+	dead1, dead2 := newDeadTracker(), newDeadTracker()
+
+	tl := NewTrackerList([][]string{{dead1, good, dead2}, {newTrackerServer(t, 20).URL}})
+
+	resp, err := tl.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 10, resp.Interval)
+	require.Equal(t, good, tl.Tiers()[0][0])
+	require.ElementsMatch(t, []string{dead1, good, dead2}, tl.Tiers()[0])
+}
+
+func TestTrackerList_FallsBackAcrossTiers(t *testing.T) {
+	tl := NewTrackerList([][]string{
+		{newDeadTracker(), "wss://tracker.example/announce"},
+		{newTrackerServer(t, 20).URL},
+	})
+
+	resp, err := tl.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 20, resp.Interval)
+}
+
+func TestTrackerList_FallsBackFromHangingTracker(t *testing.T) {
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	tl := NewTrackerList([][]string{{hanging.URL + "/announce"}, {newTrackerServer(t, 20).URL}})
+	tl.Timeout = 100 * time.Millisecond
+
+	resp, err := tl.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 20, resp.Interval)
+}
+
+func TestTrackerList_AllFail(t *testing.T) {
+	tl := NewTrackerList([][]string{{newDeadTracker()}, {newDeadTracker()}})
+
+	_, err := tl.Announce(context.Background(), &AnnounceRequest{})
+	require.Error(t, err)
+
+	_, err = NewTrackerList(nil).Announce(context.Background(), &AnnounceRequest{})
+	require.Error(t, err)
+}
+
+func TestTrackerList_Restore(t *testing.T) {
+	tl := NewTrackerList([][]string{{"udp://a", "udp://b", "udp://c"}, {"udp://d", "udp://e"}})
+
+	tl.restore([][]string{{"udp://c", "udp://a", "udp://b"}, {"udp://e", "udp://x"}})
+
+	tiers := tl.Tiers()
+	require.Equal(t, []string{"udp://c", "udp://a", "udp://b"}, tiers[0])
+	require.ElementsMatch(t, []string{"udp://d", "udp://e"}, tiers[1])
+}
+
+func TestTrackerList_StartsNewTracker(t *testing.T) {
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, r.URL.Query().Get("event"))
+		buf, _ := bencode.Marshal(map[string]any{"interval": 10, "peers": ""})
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	// the first tier is gone, so the regular announce fails over to a
+	// tracker that never heard of us
+	tl := NewTrackerList([][]string{{newDeadTracker()}, {srv.URL}})
+	for _, event := range []Event{EventNone, EventNone, EventStopped} {
+		_, err := tl.Announce(context.Background(), &AnnounceRequest{Event: event})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"started", "", "stopped"}, events)
+}
@@ -0,0 +1,56 @@
+package torrent
+
+import (
+	"testing"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerResponse_Peers(t *testing.T) {
+	compact := string([]byte{127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2})
+	compact6 := string(append(make([]byte, 15), 1, 0x1a, 0xe1))
+
+	cases := []struct {
+		name  string
+		input map[string]any
+		want  []Peer
+	}{
+		{
+			name: "dictionary list",
+			input: map[string]any{"peers": []any{
+				map[string]any{"ip": "10.0.0.1", "port": 6881, "peer id": "-GO0001-000000000000"},
+			}},
+			want: []Peer{{IP: "10.0.0.1", Port: 6881, PeerID: ptr("-GO0001-000000000000")}},
+		},
+		{
+			name:  "compact",
+			input: map[string]any{"peers": compact},
+			want:  []Peer{{IP: "127.0.0.1", Port: 6881}, {IP: "10.0.0.2", Port: 6882}},
+		},
+		{
+			name:  "compact with peers6",
+			input: map[string]any{"peers": compact[:6], "peers6": compact6},
+			want:  []Peer{{IP: "127.0.0.1", Port: 6881}, {IP: "::1", Port: 6881}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := bencode.Marshal(tc.input)
+			require.NoError(t, err)
+
+			var resp TrackerResponse
+			require.NoError(t, bencode.Unmarshal(raw, &resp))
+			require.Equal(t, tc.want, resp.AllPeers())
+		})
+	}
+
+	var resp TrackerResponse
+	require.Error(t, bencode.Unmarshal([]byte("d5:peers5:abcdee"), &resp))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
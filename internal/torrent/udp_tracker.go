@@ -0,0 +1,282 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDTTL is how long a connection ID may be used after it was
+	// received.
+	udpConnectionIDTTL = time.Minute
+	// udpMaxRetransmits is the n in the 15 * 2 ^ n retransmission timeout.
+	udpMaxRetransmits = 8
+	// udpMaxScrapeHashes is the number of info hashes that fit in a single
+	// scrape request.
+	udpMaxScrapeHashes = 74
+)
+
+var ErrTrackerTimeout = errors.New("tracker did not respond")
+
+// UDPTracker is a client for the UDP tracker protocol (BEP 15). It is safe for
+// concurrent use; requests are serialized.
+type UDPTracker struct {
+	Addr string
+	// Timeout is the initial timeout which is doubled on every retransmission.
+	Timeout time.Duration
+	// MaxRetransmits is the number of times a request is retransmitted before
+	// giving up.
+	MaxRetransmits int
+
+	mu       sync.Mutex
+	conn     net.Conn
+	connID   uint64
+	connTime time.Time
+}
+
+func NewUDPTracker(addr string) *UDPTracker {
+	return &UDPTracker{
+		Addr:           addr,
+		Timeout:        15 * time.Second,
+		MaxRetransmits: udpMaxRetransmits,
+	}
+}
+
+func (t *UDPTracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func (t *UDPTracker) dial() (net.Conn, error) {
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := net.Dial("udp", t.Addr)
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+func (t *UDPTracker) isIPv6() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return false
+	}
+	addr, ok := t.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+func newTransactionID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// exchangeOnce sends packet and waits for the response carrying the same
+// transaction ID, up to the timeout of the n-th retransmission or until ctx
+// is done.
+func (t *UDPTracker) exchangeOnce(ctx context.Context, conn net.Conn, n int, packet []byte, action uint32) ([]byte, error) {
+	txID := binary.BigEndian.Uint32(packet[12:16])
+
+	conn.SetDeadline(time.Now().Add(t.Timeout << n))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(packet); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		nr, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, ErrTrackerTimeout
+			}
+			return nil, err
+		}
+
+		resp := buf[:nr]
+		if len(resp) < 8 || binary.BigEndian.Uint32(resp[4:8]) != txID {
+			continue
+		}
+
+		switch got := binary.BigEndian.Uint32(resp[0:4]); got {
+		case action:
+			return resp, nil
+		case udpActionError:
+			return nil, fmt.Errorf("tracker error: %s", resp[8:])
+		default:
+			return nil, fmt.Errorf("unexpected tracker action: got %d, expected %d", got, action)
+		}
+	}
+}
+
+// exchange sends a request with the given action and body, connecting first
+// if there is no valid connection ID, and retransmits on timeout.
+func (t *UDPTracker) exchange(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	for n := 0; n <= t.MaxRetransmits; n++ {
+		if time.Since(t.connTime) > udpConnectionIDTTL {
+			txID, err := newTransactionID()
+			if err != nil {
+				return nil, err
+			}
+
+			packet := make([]byte, 16)
+			binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+			binary.BigEndian.PutUint32(packet[8:12], udpActionConnect)
+			binary.BigEndian.PutUint32(packet[12:16], txID)
+
+			resp, err := t.exchangeOnce(ctx, conn, n, packet, udpActionConnect)
+			if errors.Is(err, ErrTrackerTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(resp) < 16 {
+				return nil, fmt.Errorf("connect response too short: %d", len(resp))
+			}
+
+			t.connID = binary.BigEndian.Uint64(resp[8:16])
+			t.connTime = time.Now()
+		}
+
+		txID, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+
+		packet := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(packet[0:8], t.connID)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		binary.BigEndian.PutUint32(packet[12:16], txID)
+		copy(packet[16:], body)
+
+		resp, err := t.exchangeOnce(ctx, conn, n, packet, action)
+		if errors.Is(err, ErrTrackerTimeout) {
+			continue
+		}
+		return resp, err
+	}
+
+	return nil, ErrTrackerTimeout
+}
+
+func (t *UDPTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+
+	body := make([]byte, 82)
+	copy(body[0:20], req.InfoHash[:])
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], uint32(req.Event))
+	// body[68:72] is the IP address, 0 lets the tracker use the sender's
+	binary.BigEndian.PutUint32(body[72:76], req.Key)
+	binary.BigEndian.PutUint32(body[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+
+	resp, err := t.exchange(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("announce response too short: %d", len(resp))
+	}
+
+	// the tracker replies with peers of the address family it was reached over
+	peerLen := compactPeerLen
+	if t.isIPv6() {
+		peerLen = compactPeer6Len
+	}
+
+	peers, err := parsePeersCompact(resp[20:], peerLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp[8:12])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[12:16])),
+		Complete:   int(binary.BigEndian.Uint32(resp[16:20])),
+		Peers:      peers,
+	}, nil
+}
+
+// Scrape requests the swarm state of up to 74 torrents at once.
+func (t *UDPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) (map[[20]byte]ScrapeStats, error) {
+	if len(infoHashes) == 0 || len(infoHashes) > udpMaxScrapeHashes {
+		return nil, fmt.Errorf("scrape needs between 1 and %d info hashes, got %d", udpMaxScrapeHashes, len(infoHashes))
+	}
+
+	body := make([]byte, 0, 20*len(infoHashes))
+	for _, hash := range infoHashes {
+		body = append(body, hash[:]...)
+	}
+
+	resp, err := t.exchange(ctx, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 8+12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response too short: %d", len(resp))
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(infoHashes))
+	for i, hash := range infoHashes {
+		b := resp[8+12*i:]
+		stats[hash] = ScrapeStats{
+			Complete:   int(binary.BigEndian.Uint32(b[0:4])),
+			Downloaded: int(binary.BigEndian.Uint32(b[4:8])),
+			Incomplete: int(binary.BigEndian.Uint32(b[8:12])),
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,209 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// udpTrackerStub is a minimal in-process BEP 15 tracker.
+type udpTrackerStub struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	connects int
+	announce []byte
+	// drop is the number of incoming packets to ignore, to force
+	// retransmissions.
+	drop int
+}
+
+func newUDPTrackerStub(t *testing.T) *udpTrackerStub {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	s := &udpTrackerStub{conn: conn}
+	go s.serve()
+	return s
+}
+
+func (s *udpTrackerStub) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *udpTrackerStub) serve() {
+	const connID = 0xdeadbeef
+	buf := make([]byte, 2048)
+
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+
+		s.mu.Lock()
+		if s.drop > 0 {
+			s.drop--
+			s.mu.Unlock()
+			continue
+		}
+		s.mu.Unlock()
+
+		action := binary.BigEndian.Uint32(req[8:12])
+		resp := binary.BigEndian.AppendUint32(nil, action)
+		resp = append(resp, req[12:16]...)
+
+		switch action {
+		case udpActionConnect:
+			if binary.BigEndian.Uint64(req[0:8]) != udpProtocolID {
+				continue
+			}
+			s.mu.Lock()
+			s.connects++
+			s.mu.Unlock()
+			resp = binary.BigEndian.AppendUint64(resp, connID)
+		case udpActionAnnounce, udpActionScrape:
+			if binary.BigEndian.Uint64(req[0:8]) != connID {
+				resp = binary.BigEndian.AppendUint32(nil, udpActionError)
+				resp = append(resp, req[12:16]...)
+				resp = append(resp, "bad connection id"...)
+				break
+			}
+			if action == udpActionAnnounce {
+				s.mu.Lock()
+				s.announce = append([]byte(nil), req[16:]...)
+				s.mu.Unlock()
+				resp = binary.BigEndian.AppendUint32(resp, 1800)
+				resp = binary.BigEndian.AppendUint32(resp, 3)
+				resp = binary.BigEndian.AppendUint32(resp, 7)
+				resp = append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+			} else {
+				for i := 16; i+20 <= len(req); i += 20 {
+					resp = binary.BigEndian.AppendUint32(resp, uint32(req[i]))
+					resp = binary.BigEndian.AppendUint32(resp, 100)
+					resp = binary.BigEndian.AppendUint32(resp, 2)
+				}
+			}
+		}
+
+		s.conn.WriteToUDP(resp, from)
+	}
+}
+
+func TestUDPTracker_Announce(t *testing.T) {
+	stub := newUDPTrackerStub(t)
+
+	tr, err := NewTracker("udp://" + stub.addr() + "/announce")
+	require.NoError(t, err)
+	udp := tr.(*UDPTracker)
+	defer udp.Close()
+
+	req := &AnnounceRequest{
+		InfoHash: [20]byte{1},
+		PeerID:   [20]byte{2},
+		Port:     6881,
+		Left:     1000,
+		Event:    EventStarted,
+	}
+
+	resp, err := tr.Announce(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, 1800, resp.Interval)
+	require.Equal(t, 3, resp.Incomplete)
+	require.Equal(t, 7, resp.Complete)
+	require.Equal(t, []Peer{{IP: "10.0.0.1", Port: 6881}}, resp.AllPeers())
+
+	stub.mu.Lock()
+	require.Equal(t, req.InfoHash[:], stub.announce[0:20])
+	require.Equal(t, uint64(1000), binary.BigEndian.Uint64(stub.announce[48:56]))
+	require.Equal(t, uint32(EventStarted), binary.BigEndian.Uint32(stub.announce[64:68]))
+	require.Equal(t, uint16(6881), binary.BigEndian.Uint16(stub.announce[80:82]))
+	stub.mu.Unlock()
+
+	// the connection ID is reused while it is valid
+	_, err = tr.Announce(context.Background(), req)
+	require.NoError(t, err)
+
+	stats, err := udp.Scrape(context.Background(), [20]byte{5}, [20]byte{9})
+	require.NoError(t, err)
+	require.Equal(t, map[[20]byte]ScrapeStats{
+		{5}: {Complete: 5, Downloaded: 100, Incomplete: 2},
+		{9}: {Complete: 9, Downloaded: 100, Incomplete: 2},
+	}, stats)
+
+	stub.mu.Lock()
+	require.Equal(t, 1, stub.connects)
+	stub.mu.Unlock()
+}
+
+func TestUDPTracker_Retransmit(t *testing.T) {
+	stub := newUDPTrackerStub(t)
+	stub.mu.Lock()
+	stub.drop = 2
+	stub.mu.Unlock()
+
+	tr := NewUDPTracker(stub.addr())
+	tr.Timeout = 20 * time.Millisecond
+	defer tr.Close()
+
+	_, err := tr.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+}
+
+func TestUDPTracker_Timeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	tr := NewUDPTracker(conn.LocalAddr().String())
+	tr.Timeout = 5 * time.Millisecond
+	tr.MaxRetransmits = 2
+	defer tr.Close()
+
+	_, err = tr.Announce(context.Background(), &AnnounceRequest{})
+	require.ErrorIs(t, err, ErrTrackerTimeout)
+}
+
+func TestUDPTracker_Cancel(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	tr := NewUDPTracker(conn.LocalAddr().String())
+	defer tr.Close()
+
+	// a context without a deadline still ends the wait for a response
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = tr.Announce(ctx, &AnnounceRequest{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestTrackerList_UDPRetransmitWithinTimeout(t *testing.T) {
+	stub := newUDPTrackerStub(t)
+	stub.mu.Lock()
+	stub.drop = 1
+	stub.mu.Unlock()
+
+	url := "udp://" + stub.addr()
+	tl := NewTrackerList([][]string{{url}})
+	defer tl.Close()
+	tr, err := tl.tracker(url)
+	require.NoError(t, err)
+	udp := tr.(*UDPTracker)
+	udp.Timeout = 50 * time.Millisecond
+
+	require.Greater(t, tl.timeout(udp), udp.Timeout<<1)
+	_, err = tl.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+}
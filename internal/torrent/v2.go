@@ -0,0 +1,238 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// merkleBlockSize is the size of the leaves of v2 merkle trees (BEP 52).
+const merkleBlockSize = 16 << 10
+
+// errNoPieceLayers is returned for v2 torrents whose piece layers are
+// unknown, e.g. when only the info dictionary was fetched from a magnet link.
+var errNoPieceLayers = errors.New("piece layers are missing")
+
+// pieceV2 is what a piece of a v2 torrent is checked against: the root of
+// the merkle tree over its blocks. Every piece lies in a single file.
+type pieceV2 struct {
+	root [32]byte
+	// length is the number of bytes of file data in the piece; the rest of
+	// the piece is padding.
+	length int
+	// width is the number of leaves of the piece's tree. Leaves past the end
+	// of the file are zero.
+	width int
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// blockHashes returns the SHA-256 of every merkleBlockSize block of data.
+func blockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+	for off := 0; off < len(data); off += merkleBlockSize {
+		hashes = append(hashes, sha256.Sum256(data[off:min(off+merkleBlockSize, len(data))]))
+	}
+	return hashes
+}
+
+// merkleRoot returns the root of the tree whose bottom layer is hashes,
+// padded with pad to width nodes, a power of two.
+func merkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	var pair [64]byte
+	for len(layer) > 1 {
+		for i := range len(layer) / 2 {
+			copy(pair[:32], layer[2*i][:])
+			copy(pair[32:], layer[2*i+1][:])
+			layer[i] = sha256.Sum256(pair[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// fileV2 is a file of a v2 file tree.
+type fileV2 struct {
+	path   []string
+	length int
+	root   string
+}
+
+// parseFileTree flattens a v2 file tree into its files, ordered by path.
+// A file is a dictionary with a single empty key holding its attributes.
+func parseFileTree(tree map[string]any, dir []string) ([]fileV2, error) {
+	var files []fileV2
+
+	for _, name := range slices.Sorted(maps.Keys(tree)) {
+		if !validPathSegment(name) {
+			return nil, fmt.Errorf("invalid path segment in file tree: %q", name)
+		}
+		node, ok := tree[name].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid file tree entry %q", name)
+		}
+		path := append(slices.Clone(dir), name)
+
+		if leaf, ok := node[""]; ok {
+			attrs, ok := leaf.(map[string]any)
+			if !ok || len(node) != 1 {
+				return nil, fmt.Errorf("invalid file tree entry %q", name)
+			}
+			length, ok := attrs["length"].(int)
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("invalid length for file %q", name)
+			}
+			root, _ := attrs["pieces root"].(string)
+			if length > 0 && len(root) != sha256.Size {
+				return nil, fmt.Errorf("invalid pieces root for file %q", name)
+			}
+			files = append(files, fileV2{path: path, length: length, root: root})
+			continue
+		}
+
+		sub, err := parseFileTree(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+
+	return files, nil
+}
+
+// layoutV2 returns the files of a v2 info dictionary with the padding that
+// aligns every file to a piece boundary, their total length, and the pieces
+// of every file. The pieces are nil, along with errNoPieceLayers, if a file
+// spanning several pieces has no entry in layers.
+func (info *bencodeInfo) layoutV2(layers map[string]string) ([]File, int, []pieceV2, error) {
+	pieceLength := info.PieceLength
+	if pieceLength < merkleBlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, 0, nil, fmt.Errorf("invalid v2 piece length: %d", pieceLength)
+	}
+	blocksPerPiece := pieceLength / merkleBlockSize
+	padHash := merkleRoot(nil, blocksPerPiece, [32]byte{})
+
+	tree, err := parseFileTree(info.FileTree, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(tree) == 0 {
+		return nil, 0, nil, errors.New("empty file tree")
+	}
+	single := len(tree) == 1 && len(tree[0].path) == 1
+
+	var (
+		files   []File
+		pieces  []pieceV2
+		missing bool
+		offset  int
+	)
+	for i, f := range tree {
+		path := f.path
+		if !single {
+			path = append([]string{info.Name}, f.path...)
+		}
+		files = append(files, File{Path: path, Length: f.length, Offset: offset})
+		offset += f.length
+
+		numPieces := (f.length + pieceLength - 1) / pieceLength
+		switch {
+		case f.length == 0:
+		case numPieces == 1:
+			pieces = append(pieces, pieceV2{
+				root:   [32]byte([]byte(f.root)),
+				length: f.length,
+				width:  nextPow2((f.length + merkleBlockSize - 1) / merkleBlockSize),
+			})
+		default:
+			layer, ok := layers[f.root]
+			if !ok {
+				missing = true
+				break
+			}
+			if len(layer) != numPieces*sha256.Size {
+				return nil, 0, nil, fmt.Errorf("piece layer of %q has wrong length: %d", strings.Join(f.path, "/"), len(layer))
+			}
+			hashes := make([][32]byte, numPieces)
+			for j := range hashes {
+				hashes[j] = [32]byte([]byte(layer[j*sha256.Size : (j+1)*sha256.Size]))
+			}
+			if merkleRoot(hashes, nextPow2(numPieces), padHash) != [32]byte([]byte(f.root)) {
+				return nil, 0, nil, fmt.Errorf("piece layer of %q doesn't match its root", strings.Join(f.path, "/"))
+			}
+			for j, hash := range hashes {
+				pieces = append(pieces, pieceV2{
+					root:   hash,
+					length: min(pieceLength, f.length-j*pieceLength),
+					width:  blocksPerPiece,
+				})
+			}
+		}
+
+		if pad := (pieceLength - f.length%pieceLength) % pieceLength; pad > 0 && i < len(tree)-1 {
+			files = append(files, File{
+				Path:    []string{".pad", strconv.Itoa(pad)},
+				Length:  pad,
+				Offset:  offset,
+				Padding: true,
+			})
+			offset += pad
+		}
+	}
+
+	if missing {
+		return files, offset, nil, errNoPieceLayers
+	}
+	return files, offset, pieces, nil
+}
+
+// sameFiles reports whether the v1 and v2 layouts of a hybrid torrent
+// describe the same files.
+func sameFiles(v1, v2 []File) bool {
+	v1 = slices.DeleteFunc(slices.Clone(v1), func(f File) bool { return f.Padding })
+	v2 = slices.DeleteFunc(slices.Clone(v2), func(f File) bool { return f.Padding })
+	return slices.EqualFunc(v1, v2, func(a, b File) bool {
+		return slices.Equal(a.Path, b.Path) && a.Length == b.Length && a.Offset == b.Offset
+	})
+}
+
+// numPieces returns the number of pieces, known from the v1 hashes, the v2
+// pieces or both.
+func (tf *TorrentFile) numPieces() int {
+	if tf.Pieces != nil {
+		return len(tf.Pieces)
+	}
+	return len(tf.piecesV2)
+}
+
+// checkHash reports whether buf is the piece, checking both its v1 and v2
+// hashes for hybrid torrents.
+func (tf *TorrentFile) checkHash(index int, buf []byte) bool {
+	if tf.Pieces != nil && sha1.Sum(buf) != tf.Pieces[index] {
+		return false
+	}
+	if tf.piecesV2 != nil {
+		p := tf.piecesV2[index]
+		if merkleRoot(blockHashes(buf[:p.length]), p.width, [32]byte{}) != p.root {
+			return false
+		}
+	}
+	return tf.Pieces != nil || tf.piecesV2 != nil
+}
@@ -0,0 +1,273 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"test/pkg/bencode"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testFileV2 struct {
+	path string
+	data []byte
+}
+
+// newTestTorrentV2 returns the bencoded v2 torrent of files, which must be
+// sorted by path, along with the data as laid out in pieces, padding
+// included. A hybrid torrent also carries the v1 files and pieces.
+func newTestTorrentV2(t *testing.T, name string, files []testFileV2, pieceLength int, hybrid bool) ([]byte, []byte) {
+	t.Helper()
+
+	blocksPerPiece := pieceLength / merkleBlockSize
+	padHash := merkleRoot(nil, blocksPerPiece, [32]byte{})
+
+	tree := map[string]any{}
+	layers := map[string]any{}
+	var v1Files []any
+	var data []byte
+	for i, f := range files {
+		attrs := map[string]any{"length": len(f.data)}
+		if len(f.data) > 0 {
+			var pieces [][32]byte
+			for off := 0; off < len(f.data); off += pieceLength {
+				piece := f.data[off:min(off+pieceLength, len(f.data))]
+				pieces = append(pieces, merkleRoot(blockHashes(piece), blocksPerPiece, [32]byte{}))
+			}
+
+			var root [32]byte
+			if len(pieces) == 1 {
+				blocks := blockHashes(f.data)
+				root = merkleRoot(blocks, nextPow2(len(blocks)), [32]byte{})
+			} else {
+				root = merkleRoot(pieces, nextPow2(len(pieces)), padHash)
+				var layer []byte
+				for _, p := range pieces {
+					layer = append(layer, p[:]...)
+				}
+				layers[string(root[:])] = string(layer)
+			}
+			attrs["pieces root"] = string(root[:])
+		}
+
+		dir := tree
+		segs := strings.Split(f.path, "/")
+		for _, seg := range segs[:len(segs)-1] {
+			if _, ok := dir[seg]; !ok {
+				dir[seg] = map[string]any{}
+			}
+			dir = dir[seg].(map[string]any)
+		}
+		dir[segs[len(segs)-1]] = map[string]any{"": attrs}
+
+		data = append(data, f.data...)
+		v1Files = append(v1Files, map[string]any{"length": len(f.data), "path": segs})
+		if pad := (pieceLength - len(f.data)%pieceLength) % pieceLength; pad > 0 && i < len(files)-1 {
+			data = append(data, make([]byte, pad)...)
+			v1Files = append(v1Files, map[string]any{
+				"length": pad,
+				"path":   []string{".pad", strconv.Itoa(pad)},
+				"attr":   "p",
+			})
+		}
+	}
+
+	info := map[string]any{
+		"name":         name,
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for off := 0; off < len(data); off += pieceLength {
+			sum := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+			pieces = append(pieces, sum[:]...)
+		}
+		info["pieces"] = string(pieces)
+		if len(files) == 1 && !strings.Contains(files[0].path, "/") {
+			info["length"] = len(data)
+		} else {
+			info["files"] = v1Files
+		}
+	}
+
+	raw, err := bencode.Marshal(map[string]any{"info": info, "piece layers": layers})
+	require.NoError(t, err)
+	return raw, data
+}
+
+func parseTestTorrentV2(t *testing.T, raw []byte) *TorrentFile {
+	t.Helper()
+
+	var bto bencodeTorrent
+	require.NoError(t, bencode.Unmarshal(raw, &bto))
+	tf, err := bto.toTorrentFile()
+	require.NoError(t, err)
+	return tf
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, buf)
+	require.NoError(t, err)
+	return buf
+}
+
+func testFilesV2(t *testing.T) []testFileV2 {
+	return []testFileV2{
+		{path: "a", data: randomBytes(t, 70000)},
+		{path: "b/c", data: randomBytes(t, 5000)},
+		{path: "empty", data: nil},
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	data := randomBytes(t, 2*merkleBlockSize+100)
+
+	h := func(a, b [32]byte) [32]byte { return sha256.Sum256(append(a[:], b[:]...)) }
+	h0 := sha256.Sum256(data[:merkleBlockSize])
+	h1 := sha256.Sum256(data[merkleBlockSize : 2*merkleBlockSize])
+	h2 := sha256.Sum256(data[2*merkleBlockSize:])
+
+	require.Equal(t, h(h(h0, h1), h(h2, [32]byte{})), merkleRoot(blockHashes(data), 4, [32]byte{}))
+	require.Equal(t, h0, merkleRoot(blockHashes(data[:merkleBlockSize]), 1, [32]byte{}))
+}
+
+func TestParseInfo_V2(t *testing.T) {
+	raw, data := newTestTorrentV2(t, "root", testFilesV2(t), 32768, false)
+	tf := parseTestTorrentV2(t, raw)
+
+	var bto bencodeTorrent
+	require.NoError(t, bencode.Unmarshal(raw, &bto))
+	require.Equal(t, sha256.Sum256(bto.Info), tf.InfoHashV2)
+	require.Equal(t, tf.InfoHashV2[:20], tf.InfoHash[:])
+	require.Nil(t, tf.Pieces)
+	require.True(t, tf.IsMultiFile())
+
+	require.Equal(t, []File{
+		{Path: []string{"root", "a"}, Length: 70000, Offset: 0},
+		{Path: []string{".pad", "28304"}, Length: 28304, Offset: 70000, Padding: true},
+		{Path: []string{"root", "b", "c"}, Length: 5000, Offset: 98304},
+		{Path: []string{".pad", "27768"}, Length: 27768, Offset: 103304, Padding: true},
+		{Path: []string{"root", "empty"}, Length: 0, Offset: 131072},
+	}, tf.Files)
+	require.Equal(t, len(data), tf.Length)
+	require.Equal(t, 4, tf.numPieces())
+
+	for i := range tf.numPieces() {
+		begin, end := tf.pieceBounds(i)
+		require.True(t, tf.checkHash(i, data[begin:end]), i)
+	}
+
+	corrupt := bytes.Clone(data[:32768])
+	corrupt[100] ^= 0xff
+	require.False(t, tf.checkHash(0, corrupt))
+
+	// without piece layers the pieces of "a" can't be checked
+	_, err := parseInfo(bto.Info, nil)
+	require.ErrorIs(t, err, errNoPieceLayers)
+
+	for root := range bto.PieceLayers {
+		bto.PieceLayers[root] = strings.Repeat("x", len(bto.PieceLayers[root]))
+	}
+	_, err = parseInfo(bto.Info, bto.PieceLayers)
+	require.Error(t, err)
+}
+
+func TestParseInfo_V2SingleFile(t *testing.T) {
+	data := randomBytes(t, 40000)
+	raw, _ := newTestTorrentV2(t, "out.bin", []testFileV2{{path: "out.bin", data: data}}, 16384, true)
+	tf := parseTestTorrentV2(t, raw)
+
+	require.False(t, tf.IsMultiFile())
+	require.Equal(t, []File{{Path: []string{"out.bin"}, Length: 40000}}, tf.Files)
+	require.Len(t, tf.Pieces, 3)
+	require.Len(t, tf.piecesV2, 3)
+}
+
+func TestParseInfo_Hybrid(t *testing.T) {
+	raw, data := newTestTorrentV2(t, "root", testFilesV2(t), 32768, true)
+	tf := parseTestTorrentV2(t, raw)
+
+	var bto bencodeTorrent
+	require.NoError(t, bencode.Unmarshal(raw, &bto))
+	require.Equal(t, sha1.Sum(bto.Info), tf.InfoHash)
+	require.Equal(t, sha256.Sum256(bto.Info), tf.InfoHashV2)
+	require.Len(t, tf.Pieces, 4)
+	require.Len(t, tf.piecesV2, 4)
+	require.True(t, tf.Files[1].Padding)
+
+	begin, end := tf.pieceBounds(1)
+	require.True(t, tf.checkHash(1, data[begin:end]))
+
+	// both hashes have to match
+	tf.piecesV2[1].root[0] ^= 0xff
+	require.False(t, tf.checkHash(1, data[begin:end]))
+
+	// hybrid torrents work with their v1 pieces alone, e.g. from a magnet link
+	tf, err := parseInfo(bto.Info, nil)
+	require.NoError(t, err)
+	require.Nil(t, tf.piecesV2)
+	require.True(t, tf.checkHash(1, data[begin:end]))
+}
+
+func TestDownload_V2(t *testing.T) {
+	raw, data := newTestTorrentV2(t, "root", testFilesV2(t), 32768, false)
+
+	seed := parseTestTorrentV2(t, raw)
+	seed.Storage = NewMemoryStorage()
+	st, err := seed.Storage.Open(seed)
+	require.NoError(t, err)
+	for i := range seed.numPieces() {
+		begin, end := seed.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+	}
+
+	ln, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	seed.Listener = ln
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := bencode.Marshal(map[string]any{
+			"interval": 1800,
+			"peers":    []any{map[string]any{"ip": "127.0.0.1", "port": ln.Addr().(*net.TCPAddr).Port}},
+		})
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+	seed.Announce = tracker.URL + "/announce"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- seed.Seed(ctx, [20]byte{'s'}, 0) }()
+	require.Eventually(t, func() bool { return ln.session(seed.InfoHash) != nil }, 5*time.Second, 10*time.Millisecond)
+
+	leech := parseTestTorrentV2(t, raw)
+	leech.Announce = seed.Announce
+	leech.Storage = FileStorage{Dir: t.TempDir()}
+	require.NoError(t, leech.Download([20]byte{'l'}, 0))
+
+	r, err := leech.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Len(t, r.Files, 3)
+
+	cancel()
+	require.NoError(t, <-errc)
+}
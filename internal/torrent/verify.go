@@ -0,0 +1,165 @@
+package torrent
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// PieceState is the result of checking a piece against its hash.
+type PieceState int
+
+const (
+	PieceGood PieceState = iota
+	// PieceBad is a piece whose data doesn't match its hash.
+	PieceBad
+	// PieceMissing is a piece whose data couldn't be read, e.g. because a
+	// file is missing or too short.
+	PieceMissing
+)
+
+func (ps PieceState) String() string {
+	switch ps {
+	case PieceGood:
+		return "good"
+	case PieceBad:
+		return "bad"
+	case PieceMissing:
+		return "missing"
+	}
+	return "unknown"
+}
+
+// FileReport is the completeness of a single file of the torrent.
+type FileReport struct {
+	Path   []string
+	Length int
+	// Good is the number of bytes of the file that lie in good pieces.
+	Good int
+	// Missing is set for empty files that don't exist in the storage, which
+	// no piece accounts for.
+	Missing bool
+}
+
+func (fr FileReport) Complete() bool {
+	return fr.Good == fr.Length && !fr.Missing
+}
+
+// fileChecker is implemented by storages that keep the files of a torrent
+// and can tell whether one exists.
+type fileChecker interface {
+	exists(path []string) bool
+}
+
+// VerifyReport is the result of checking a torrent's data.
+type VerifyReport struct {
+	Pieces []PieceState
+	Files  []FileReport
+
+	Good, Bad, Missing int
+}
+
+// OK reports whether every piece is good and no file is missing.
+func (r *VerifyReport) OK() bool {
+	if r.Bad > 0 || r.Missing > 0 {
+		return false
+	}
+	for _, fr := range r.Files {
+		if fr.Missing {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify hashes every piece in the torrent's Storage against Pieces, spread
+// across all CPU cores, and reports which pieces and files are complete.
+func (tf *TorrentFile) Verify(ctx context.Context) (*VerifyReport, error) {
+	st, err := tf.openStorage()
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	pieces, err := tf.checkPieces(ctx, st, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &VerifyReport{Pieces: pieces}
+	for _, ps := range pieces {
+		switch ps {
+		case PieceGood:
+			r.Good++
+		case PieceBad:
+			r.Bad++
+		case PieceMissing:
+			r.Missing++
+		}
+	}
+
+	for _, f := range tf.Files {
+		if f.Padding {
+			continue
+		}
+		fr := FileReport{Path: f.Path, Length: f.Length}
+		if fc, ok := st.(fileChecker); ok && f.Length == 0 {
+			fr.Missing = !fc.exists(f.Path)
+		}
+		for off := f.Offset; off < f.Offset+f.Length; {
+			index := off / tf.PieceLength
+			_, end := tf.pieceBounds(index)
+			n := min(end, f.Offset+f.Length) - off
+			if pieces[index] == PieceGood {
+				fr.Good += n
+			}
+			off += n
+		}
+		r.Files = append(r.Files, fr)
+	}
+
+	return r, nil
+}
+
+// checkPieces hashes the pieces in st in parallel. Pieces in trusted, which
+// may be nil, are reported good without being read.
+func (tf *TorrentFile) checkPieces(ctx context.Context, st TorrentStorage, trusted bitfield) ([]PieceState, error) {
+	states := make([]PieceState, tf.numPieces())
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				states[index] = tf.checkPiece(st, index)
+			}
+		}()
+	}
+
+	var err error
+	for index := range tf.numPieces() {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if !trusted.HasPiece(index) {
+			indexes <- index
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return states, err
+}
+
+func (tf *TorrentFile) checkPiece(st TorrentStorage, index int) PieceState {
+	buf := make([]byte, tf.pieceSize(index))
+	if err := st.ReadAt(buf, index, 0); err != nil {
+		return PieceMissing
+	}
+	if !tf.checkHash(index, buf) {
+		return PieceBad
+	}
+	return PieceGood
+}
@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5)
+	dir := t.TempDir()
+
+	tf := newMultiFileTorrent(t, data)
+	tf.Storage = FileStorage{Dir: dir}
+
+	st, err := tf.openStorage()
+	require.NoError(t, err)
+	for i := range tf.Pieces {
+		begin, end := tf.pieceBounds(i)
+		require.NoError(t, st.WriteAt(data[begin:end], i, 0))
+		require.NoError(t, st.MarkComplete(i))
+	}
+	require.NoError(t, st.Close())
+	require.FileExists(t, filepath.Join(dir, "root", "empty"))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.Equal(t, len(tf.Pieces), r.Good)
+	require.True(t, r.Files[1].Complete())
+
+	// a missing empty file fails verification, though no piece covers it
+	empty := filepath.Join(dir, "root", "empty")
+	require.NoError(t, os.Remove(empty))
+	r, err = tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, len(tf.Pieces), r.Good)
+	require.True(t, r.Files[1].Missing)
+	require.False(t, r.Files[1].Complete())
+	require.False(t, r.OK())
+	require.NoError(t, os.WriteFile(empty, nil, 0o644))
+
+	// piece 1 gets a flipped byte, pieces 2 and 3 are cut off
+	b := filepath.Join(dir, "root", "sub", "b")
+	corrupt := bytes.Clone(data[7:37])
+	corrupt[13] ^= 0xff
+	require.NoError(t, os.WriteFile(b, corrupt, 0o644))
+
+	r, err = tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.False(t, r.OK())
+	require.Equal(t, []PieceState{PieceGood, PieceBad, PieceMissing, PieceMissing}, r.Pieces)
+	require.Equal(t, 1, r.Good)
+	require.Equal(t, 1, r.Bad)
+	require.Equal(t, 2, r.Missing)
+
+	require.Equal(t, []FileReport{
+		{Path: []string{"root", "a"}, Length: 7, Good: 7},
+		{Path: []string{"root", "empty"}, Length: 0, Good: 0},
+		{Path: []string{"root", "sub", "b"}, Length: 43, Good: 9},
+	}, r.Files)
+	require.True(t, r.Files[0].Complete())
+	require.False(t, r.Files[2].Complete())
+}
+
+func TestVerify_Cancelled(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", bytes.Repeat([]byte("x"), 1<<16), 16)
+	tf.Storage = NewMemoryStorage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := tf.Verify(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,247 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webSeedTimeout bounds the requests for a single piece.
+	webSeedTimeout = time.Minute
+	// webSeedRetryDelay is the delay after a failed request, multiplied by
+	// the number of consecutive failures.
+	webSeedRetryDelay = 5 * time.Second
+	// maxWebSeedFailures is the number of consecutive failures after which a
+	// web seed is given up.
+	maxWebSeedFailures = 5
+	// minBusyWait is the least we wait for a busy source, whatever it asks.
+	minBusyWait = time.Second
+	// maxBusyReplies is the number of consecutive busy replies after which a
+	// source is given up.
+	maxBusyReplies = 10
+)
+
+// pieceSource fetches whole pieces over HTTP, from a web seed or an HTTP
+// seed.
+type pieceSource interface {
+	readPiece(ctx context.Context, index int) ([]byte, error)
+	String() string
+}
+
+// retryAfterError is returned by sources that are busy and asked to be
+// retried after wait.
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("busy, retry after %v", e.wait)
+}
+
+// httpStatusError is an unexpected HTTP response status.
+type httpStatusError struct {
+	url  string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.url, e.code)
+}
+
+// webSeed fetches pieces from an HTTP mirror of the torrent data (BEP 19).
+// For single-file torrents the URL is the file itself, or the directory
+// holding it if it ends in a slash; for multi-file torrents it is the
+// directory holding the torrent's directory.
+type webSeed struct {
+	url    string
+	tf     *TorrentFile
+	client *http.Client
+}
+
+func (ws *webSeed) String() string {
+	return ws.url
+}
+
+func (ws *webSeed) fileURL(f File) string {
+	if ws.tf.mode == singlefile {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(f.Path[0])
+		}
+		return ws.url
+	}
+
+	segs := make([]string, len(f.Path))
+	for i, seg := range f.Path {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.TrimSuffix(ws.url, "/") + "/" + strings.Join(segs, "/")
+}
+
+// readPiece fetches a piece with one range request for every file it
+// spans. Padding is never requested.
+func (ws *webSeed) readPiece(ctx context.Context, index int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, webSeedTimeout)
+	defer cancel()
+
+	begin, end := ws.tf.pieceBounds(index)
+	spans, err := ws.tf.spans(begin, end-begin)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, end-begin)
+	p := buf
+	for _, span := range spans {
+		if !span.file.Padding {
+			if err := ws.readSpan(ctx, span, p[:span.n]); err != nil {
+				return nil, err
+			}
+		}
+		p = p[span.n:]
+	}
+	return buf, nil
+}
+
+func (ws *webSeed) readSpan(ctx context.Context, span fileSpan, p []byte) error {
+	u := ws.fileURL(span.file)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", span.off, span.off+span.n-1))
+
+	client := ws.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && span.off == 0 && span.n == span.file.Length:
+		// a server ignoring the range still sends what we asked for
+	default:
+		return &httpStatusError{url: u, code: resp.StatusCode}
+	}
+
+	_, err = io.ReadFull(resp.Body, p)
+	return err
+}
+
+// addWebSeeds starts a worker for every web seed URL.
+func (s *session) addWebSeeds(urls []string) {
+	for _, u := range urls {
+		s.addSource(&webSeed{url: u, tf: s.tf})
+	}
+}
+
+// addSource starts a worker downloading from src.
+func (s *session) addSource(src pieceSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return
+	}
+
+	s.active++
+	go func() {
+		defer s.workerDone()
+		s.runSource(src)
+	}()
+}
+
+// runSource downloads pieces from src like from a peer that has all of
+// them, until nothing is left to pick, the session stops or src keeps
+// failing. Client errors such as a missing file give up on src right away,
+// while a busy src is waited for as long as it asks, but at least
+// minBusyWait and only maxBusyReplies times in a row.
+func (s *session) runSource(src pieceSource) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	all := newBitfield(s.tf.numPieces())
+	for i := range s.tf.numPieces() {
+		all.SetPiece(i)
+	}
+
+	failures, busyReplies := 0, 0
+	for {
+		index, ok := s.picker.pick(all)
+		if !ok {
+			return
+		}
+
+		buf, err := src.readPiece(ctx, index)
+		if err == nil {
+			err = s.tf.checkIntegrity(index, buf)
+		}
+		if err != nil {
+			s.picker.release(index)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("web seed %s: %v", src, err)
+
+			var (
+				status *httpStatusError
+				busy   *retryAfterError
+				delay  time.Duration
+			)
+			switch {
+			case errors.As(err, &busy):
+				busyReplies++
+				if busyReplies >= maxBusyReplies {
+					return
+				}
+				delay = max(busy.wait, minBusyWait)
+			case errors.As(err, &status) && status.code < 500:
+				return
+			default:
+				failures++
+				if failures >= maxWebSeedFailures {
+					return
+				}
+				delay = time.Duration(failures) * webSeedRetryDelay
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		failures, busyReplies = 0, 0
+
+		if !s.picker.complete(index) {
+			continue
+		}
+
+		select {
+		case s.results <- &pieceResult{index: index, buf: buf}:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeed_FileURL(t *testing.T) {
+	single := &TorrentFile{mode: singlefile}
+	f := File{Path: []string{"a file.bin"}}
+	require.Equal(t, "http://m/x.bin", (&webSeed{url: "http://m/x.bin", tf: single}).fileURL(f))
+	require.Equal(t, "http://m/dir/a%20file.bin", (&webSeed{url: "http://m/dir/", tf: single}).fileURL(f))
+
+	multi := &TorrentFile{mode: multifile}
+	f = File{Path: []string{"root", "sub", "b#1"}}
+	require.Equal(t, "http://m/root/sub/b%231", (&webSeed{url: "http://m", tf: multi}).fileURL(f))
+	require.Equal(t, "http://m/root/sub/b%231", (&webSeed{url: "http://m/", tf: multi}).fileURL(f))
+}
+
+func TestDownload_WebSeed(t *testing.T) {
+	mirror := t.TempDir()
+	root := filepath.Join(mirror, "data")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sub dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a"), randomBytes(t, 50000), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sub dir", "b"), randomBytes(t, 20000), 0o644))
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	fileServer := http.FileServer(http.Dir(mirror))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Header.Get("Range"))
+		mu.Unlock()
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	buf, err := (&Builder{URLList: []string{srv.URL + "/"}}).Build(context.Background(), root)
+	require.NoError(t, err)
+	_, tf := parseTorrent(t, buf)
+	require.Equal(t, []string{srv.URL + "/"}, tf.WebSeeds)
+
+	tf.Announce = newEmptyTracker(t).URL + "/announce"
+	tf.Storage = FileStorage{Dir: t.TempDir()}
+	require.NoError(t, tf.Download([20]byte{'l'}, 0))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+	require.NotEmpty(t, requests)
+	for _, rng := range requests {
+		require.True(t, strings.HasPrefix(rng, "bytes="), rng)
+	}
+}
+
+func TestDownload_WebSeedV2(t *testing.T) {
+	files := testFilesV2(t)
+	raw, _ := newTestTorrentV2(t, "root", files, 32768, false)
+	tf := parseTestTorrentV2(t, raw)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range files {
+			if r.URL.Path == "/root/"+f.path {
+				http.ServeContent(w, r, f.path, time.Time{}, bytes.NewReader(f.data))
+				return
+			}
+		}
+		// padding is never requested
+		http.NotFound(w, r)
+		t.Errorf("unexpected request for %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	tf.WebSeeds = []string{srv.URL}
+	tf.Storage = NewMemoryStorage()
+	require.NoError(t, tf.Download([20]byte{'l'}, 0))
+
+	r, err := tf.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, r.OK())
+}
+
+func TestDownload_WebSeedMissing(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	tf.WebSeeds = []string{srv.URL + "/"}
+	tf.Storage = NewMemoryStorage()
+
+	err := tf.Download([20]byte{'l'}, 0)
+	require.ErrorContains(t, err, "all peers disconnected")
+}
+
+// busySource is a piece source that is always busy and asks not to wait.
+type busySource struct {
+	calls atomic.Int32
+}
+
+func (b *busySource) readPiece(ctx context.Context, index int) ([]byte, error) {
+	b.calls.Add(1)
+	return nil, &retryAfterError{}
+}
+
+func (b *busySource) String() string { return "busy" }
+
+func TestRunSource_WaitsForBusySource(t *testing.T) {
+	tf := newTestTorrent(t, "out.bin", []byte("some data"), 4)
+	s := newSession(tf, [20]byte{'c'}, 0, nil, nil)
+
+	src := &busySource{}
+	done := make(chan struct{})
+	go func() {
+		s.runSource(src)
+		close(done)
+	}()
+
+	time.Sleep(minBusyWait / 2)
+	require.EqualValues(t, 1, src.calls.Load())
+
+	s.close()
+	<-done
+}
@@ -1,6 +1,22 @@
 package bencode
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
+
+// Marshaler is implemented by types that can encode themselves into valid
+// bencode.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that can decode a bencoded
+// representation of themselves. The input is a single complete value and
+// must be copied if it is retained after returning.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
 
 var (
 	ErrDictKeyNotString     = errors.New("dictionary key is not string")
@@ -10,3 +26,10 @@ var (
 	ErrInvalidStringFormat  = errors.New("invalid string format")
 	ErrTrailingDataLeft     = errors.New("trailing data left")
 )
+
+// parseTag splits a struct tag into the dictionary key and the omitempty
+// option, e.g. `bencode:"private,omitempty"`.
+func parseTag(tag string) (string, bool) {
+	key, opts, _ := strings.Cut(tag, ",")
+	return key, opts == "omitempty"
+}
@@ -2,6 +2,7 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,28 @@ import (
 
 type Decoder struct {
 	r *bufio.Reader
+	// buf records every byte consumed while decoding the current value so
+	// that raw spans of sub-values can be handed to RawMessage fields.
+	buf []byte
+}
+
+// RawMessage is a raw encoded bencode value. It can be used as a struct field
+// to delay decoding or to keep the exact bytes of a value, e.g. the info
+// dictionary of a torrent, which has to be hashed as it appeared on the wire.
+type RawMessage []byte
+
+// MarshalBencode returns m as is, so a RawMessage is written back unchanged.
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("empty RawMessage")
+	}
+	return m, nil
+}
+
+// rawValue is a decoded value along with the bytes it was decoded from.
+type rawValue struct {
+	value interface{}
+	raw   []byte
 }
 
 func NewDecoder(r io.Reader) *Decoder {
@@ -19,6 +42,21 @@ func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: bufio.NewReader(r)}
 }
 
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.buf = append(d.buf, b)
+	return b, nil
+}
+
+func (d *Decoder) readFull(p []byte) error {
+	n, err := io.ReadFull(d.r, p)
+	d.buf = append(d.buf, p[:n]...)
+	return err
+}
+
 // it would be much simple to just create [2]buffer to check first 2 characters to handle leading zeros instead of doing these condition soup
 func (d *Decoder) readIntBytes(delim byte) (int, error) {
 	n := 0
@@ -26,7 +64,7 @@ func (d *Decoder) readIntBytes(delim byte) (int, error) {
 	seenDigit := false
 
 	for {
-		b, err := d.r.ReadByte()
+		b, err := d.readByte()
 		if err != nil {
 			if err == io.EOF {
 				return 0, ErrInvalidIntegerFormat
@@ -70,7 +108,7 @@ func (d *Decoder) readIntBytes(delim byte) (int, error) {
 }
 
 func (d *Decoder) readInt() (int, error) {
-	d.r.ReadByte()
+	d.readByte()
 	return d.readIntBytes('e')
 }
 
@@ -88,8 +126,7 @@ func (d *Decoder) readString() (string, error) {
 	}
 
 	str := make([]byte, intN)
-	_, err = io.ReadFull(d.r, str)
-	if err != nil {
+	if err := d.readFull(str); err != nil {
 		return "", err
 	}
 
@@ -97,7 +134,7 @@ func (d *Decoder) readString() (string, error) {
 }
 
 func (d *Decoder) readList() ([]interface{}, error) {
-	d.r.ReadByte()
+	d.readByte()
 	list := make([]interface{}, 0)
 
 	for {
@@ -123,14 +160,14 @@ func (d *Decoder) peekConsumeEnd() error {
 		return err
 	}
 	if b[0] == 'e' {
-		d.r.ReadByte()
+		d.readByte()
 		return errEnd
 	}
 	return nil
 }
 
 func (d *Decoder) readDict() (map[string]interface{}, error) {
-	d.r.ReadByte()
+	d.readByte()
 	dict := make(map[string]interface{})
 
 	for {
@@ -146,7 +183,7 @@ func (d *Decoder) readDict() (map[string]interface{}, error) {
 			return nil, err
 		}
 
-		k, ok := key.(string)
+		k, ok := key.(rawValue).value.(string)
 		if !ok {
 			return nil, ErrDictKeyNotString
 		}
@@ -160,35 +197,93 @@ func (d *Decoder) readDict() (map[string]interface{}, error) {
 	}
 }
 
+// decode reads the next value and wraps it in a rawValue. Lists and
+// dictionaries hold rawValue elements as well.
 func (d *Decoder) decode() (interface{}, error) {
 	b, err := d.r.Peek(1)
 	if err != nil {
 		return nil, err
 	}
 
+	start := len(d.buf)
+
+	var v interface{}
 	switch b[0] {
 	case 'l':
-		return d.readList()
+		v, err = d.readList()
 	case 'd':
-		return d.readDict()
+		v, err = d.readDict()
 	case 'i':
-		return d.readInt()
+		v, err = d.readInt()
 	default:
-		return d.readString()
+		v, err = d.readString()
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	return rawValue{value: v, raw: d.buf[start:len(d.buf):len(d.buf)]}, nil
 }
 
 func (d *Decoder) Decode(src interface{}) error {
+	d.buf = d.buf[:0]
 	data, err := d.decode()
 	if err != nil {
 		return err
 	}
+	d.buf = nil
 	if d.r.Buffered() > 0 {
 		return ErrTrailingDataLeft
 	}
 	return unmarshal(src, data)
 }
 
+// Unmarshal decodes the bencoded data into the value pointed to by v.
+func Unmarshal(data []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// UnmarshalPrefix decodes the first bencoded value of data into v and returns
+// the number of bytes it occupied. Unlike Unmarshal, data may continue past
+// the value, as in messages that carry a bencoded header followed by a raw
+// payload.
+func UnmarshalPrefix(data []byte, v interface{}) (int, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	value, err := d.decode()
+	if err != nil {
+		return 0, err
+	}
+	n := len(d.buf)
+	if err := unmarshal(v, value); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// plain strips the rawValue wrappers from a decoded tree.
+func plain(data interface{}) interface{} {
+	if rv, ok := data.(rawValue); ok {
+		data = rv.value
+	}
+
+	switch v := data.(type) {
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = plain(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		dict := make(map[string]interface{}, len(v))
+		for k := range v {
+			dict[k] = plain(v[k])
+		}
+		return dict
+	}
+
+	return data
+}
+
 func unmarshal(src, data interface{}) error {
 	if reflect.TypeOf(src).Kind() != reflect.Pointer {
 		return errors.New("src needs to be a pointer")
@@ -196,6 +291,20 @@ func unmarshal(src, data interface{}) error {
 	return decodeInto(reflect.ValueOf(src).Elem(), data)
 }
 
+var (
+	rawMessageType  = reflect.TypeOf(RawMessage{})
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// rawBytes returns the encoded form of data, re-encoding it when the original
+// bytes are not available.
+func rawBytes(data interface{}) ([]byte, error) {
+	if rv, ok := data.(rawValue); ok {
+		return rv.raw, nil
+	}
+	return Marshal(data)
+}
+
 func decodeInto(dst reflect.Value, data interface{}) error {
 	t := dst.Type()
 
@@ -205,8 +314,24 @@ func decodeInto(dst reflect.Value, data interface{}) error {
 		t = dst.Type()
 	}
 
+	if dst.CanAddr() && t.Kind() != reflect.Interface && dst.Addr().Type().Implements(unmarshalerType) {
+		raw, err := rawBytes(data)
+		if err != nil {
+			return err
+		}
+		return dst.Addr().Interface().(Unmarshaler).UnmarshalBencode(raw)
+	}
+
+	if rv, ok := data.(rawValue); ok {
+		if t == rawMessageType {
+			dst.SetBytes(append([]byte(nil), rv.raw...))
+			return nil
+		}
+		data = rv.value
+	}
+
 	if t.Kind() == reflect.Interface {
-		dst.Set(reflect.ValueOf(data))
+		dst.Set(reflect.ValueOf(plain(data)))
 		return nil
 	}
 
@@ -297,8 +422,8 @@ func decodeIntoStruct(dst reflect.Value, data interface{}) error {
 			continue
 		}
 
-		key := fieldType.Tag.Get("bencode")
-		if key == "" {
+		key, _ := parseTag(fieldType.Tag.Get("bencode"))
+		if key == "" || key == "-" {
 			continue
 		}
 
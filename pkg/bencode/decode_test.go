@@ -244,3 +244,39 @@ func TestDecode_Dictionary(t *testing.T) {
 		},
 	})
 }
+
+func TestDecode_RawMessage(t *testing.T) {
+	type torrent struct {
+		Announce string      `bencode:"announce"`
+		Info     RawMessage  `bencode:"info"`
+		Nodes    *RawMessage `bencode:"nodes"`
+	}
+
+	info := "d6:lengthi1e4:name1:a5:zzzzzi0e3:abc3:defe"
+	input := "d8:announce3:url4:info" + info + "5:nodesl1:ai1eee"
+
+	var v torrent
+	require.NoError(t, NewDecoder(bytes.NewBufferString(input)).Decode(&v))
+	require.Equal(t, "url", v.Announce)
+	require.Equal(t, RawMessage(info), v.Info)
+	require.Equal(t, RawMessage("l1:ai1ee"), *v.Nodes)
+
+	var generic interface{}
+	require.NoError(t, Unmarshal(v.Info, &generic))
+	require.Equal(t, map[string]interface{}{"length": 1, "name": "a", "zzzzz": 0, "abc": "def"}, generic)
+
+	out, err := Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, input, string(out))
+}
+
+func TestUnmarshalPrefix(t *testing.T) {
+	var v map[string]int
+	n, err := UnmarshalPrefix([]byte("d8:msg_typei1e5:piecei0eeRAW DATA"), &v)
+	require.NoError(t, err)
+	require.Equal(t, 25, n)
+	require.Equal(t, map[string]int{"msg_type": 1, "piece": 0}, v)
+
+	_, err = UnmarshalPrefix([]byte("d8:msg_type"), &v)
+	require.Error(t, err)
+}
@@ -107,11 +107,21 @@ func structToMap(value reflect.Value) reflect.Value {
 			continue
 		}
 		key := field.Name
+		omitEmpty := false
 		if tag, ok := field.Tag.Lookup("bencode"); ok {
 			if tag == "-" {
 				continue
 			}
-			key = tag
+			key, omitEmpty = parseTag(tag)
+		}
+		if (fieldValue.Kind() == reflect.Pointer || fieldValue.Kind() == reflect.Interface) && fieldValue.IsNil() {
+			continue
+		}
+		if omitEmpty && fieldValue.IsZero() {
+			continue
+		}
+		if omitEmpty && (fieldValue.Kind() == reflect.Slice || fieldValue.Kind() == reflect.Map) && fieldValue.Len() == 0 {
+			continue
 		}
 		reflectedMap.SetMapIndex(reflect.ValueOf(key), fieldValue)
 	}
@@ -119,6 +129,33 @@ func structToMap(value reflect.Value) reflect.Value {
 	return reflectedMap
 }
 
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// asMarshaler returns the Marshaler implemented by value, or by a pointer to
+// it when the method has a pointer receiver.
+func asMarshaler(value reflect.Value) (Marshaler, bool) {
+	if !value.IsValid() {
+		return nil, false
+	}
+	if value.Type().Implements(marshalerType) {
+		return value.Interface().(Marshaler), true
+	}
+	if value.Kind() != reflect.Pointer && reflect.PointerTo(value.Type()).Implements(marshalerType) {
+		ptr := reflect.New(value.Type())
+		ptr.Elem().Set(value)
+		return ptr.Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+func (e *encoder) writeMarshaler(m Marshaler) error {
+	b, err := m.MarshalBencode()
+	if err != nil {
+		return err
+	}
+	return e.write(b)
+}
+
 func (e *encoder) encode(v any) error {
 	var value reflect.Value
 
@@ -129,6 +166,20 @@ func (e *encoder) encode(v any) error {
 		value = reflect.ValueOf(v)
 	}
 
+	for value.Kind() == reflect.Interface || value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return ErrUnsupportedEncodeType
+		}
+		if m, ok := asMarshaler(value); ok {
+			return e.writeMarshaler(m)
+		}
+		value = value.Elem()
+	}
+
+	if m, ok := asMarshaler(value); ok {
+		return e.writeMarshaler(m)
+	}
+
 	switch value.Kind() {
 	case reflect.Int,
 		reflect.Int8,
@@ -173,3 +173,25 @@ func TestBencode_Encode(t *testing.T) {
 		})
 	}
 }
+
+func TestBencode_EncodeOmitEmpty(t *testing.T) {
+	type info struct {
+		Name    string   `bencode:"name"`
+		Private int      `bencode:"private,omitempty"`
+		Source  string   `bencode:"source,omitempty"`
+		URLs    []string `bencode:"url-list,omitempty"`
+		Length  int      `bencode:"length"`
+	}
+
+	out, err := Marshal(info{Name: "a"})
+	require.NoError(t, err)
+	require.Equal(t, "d6:lengthi0e4:name1:ae", string(out))
+
+	out, err = Marshal(info{Name: "a", Private: 1, Source: "s", URLs: []string{"u"}})
+	require.NoError(t, err)
+	require.Equal(t, "d6:lengthi0e4:name1:a7:privatei1e6:source1:s8:url-listl1:uee", string(out))
+
+	var v info
+	require.NoError(t, Unmarshal(out, &v))
+	require.Equal(t, info{Name: "a", Private: 1, Source: "s", URLs: []string{"u"}}, v)
+}
@@ -0,0 +1,100 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hostPort is encoded as a "host:port" string instead of a dictionary.
+type hostPort struct {
+	Host string
+	Port int
+}
+
+func (hp hostPort) MarshalBencode() ([]byte, error) {
+	return Marshal(fmt.Sprintf("%s:%d", hp.Host, hp.Port))
+}
+
+func (hp *hostPort) UnmarshalBencode(b []byte) error {
+	var s string
+	if err := Unmarshal(b, &s); err != nil {
+		return err
+	}
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("missing port: %q", s)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	hp.Host, hp.Port = host, n
+	return nil
+}
+
+// addrs accepts either a single string or a list of strings.
+type addrs []string
+
+func (a *addrs) UnmarshalBencode(b []byte) error {
+	if len(b) > 0 && b[0] == 'l' {
+		return Unmarshal(b, (*[]string)(a))
+	}
+	var s string
+	if err := Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*a = addrs{s}
+	return nil
+}
+
+type failing struct{}
+
+var errFailing = errors.New("failing")
+
+func (failing) MarshalBencode() ([]byte, error) { return nil, errFailing }
+
+func (*failing) UnmarshalBencode([]byte) error { return errFailing }
+
+func TestMarshaler(t *testing.T) {
+	out, err := Marshal(map[string]any{"a": hostPort{"h", 1}, "b": &hostPort{"x", 2}, "c": []hostPort{{"y", 3}}})
+	require.NoError(t, err)
+	require.Equal(t, "d1:a3:h:11:b3:x:21:cl3:y:3ee", string(out))
+
+	_, err = Marshal([]any{failing{}})
+	require.ErrorIs(t, err, errFailing)
+}
+
+func TestMarshal_RawMessage(t *testing.T) {
+	type torrent struct {
+		Info RawMessage `bencode:"info"`
+	}
+
+	out, err := Marshal(torrent{Info: RawMessage("d1:ai1ee")})
+	require.NoError(t, err)
+	require.Equal(t, "d4:infod1:ai1eee", string(out))
+
+	_, err = Marshal(torrent{})
+	require.Error(t, err)
+}
+
+func TestUnmarshaler(t *testing.T) {
+	type response struct {
+		Peers addrs      `bencode:"peers"`
+		Other addrs      `bencode:"other"`
+		Hosts []hostPort `bencode:"hosts"`
+	}
+
+	var v response
+	require.NoError(t, Unmarshal([]byte("d5:hostsl4:h:124:g:23e5:other1:x5:peersl1:a1:bee"), &v))
+	require.Equal(t, addrs{"a", "b"}, v.Peers)
+	require.Equal(t, addrs{"x"}, v.Other)
+	require.Equal(t, []hostPort{{"h", 12}, {"g", 23}}, v.Hosts)
+
+	var f failing
+	require.ErrorIs(t, Unmarshal([]byte("i1e"), &f), errFailing)
+}